@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// a command received on our admin socket, handled by our main loop between cycles
+type admin_request struct {
+	command string
+	args    []string
+	reply   chan string
+}
+
+// listens on the passed in UNIX socket, passing commands received to our main loop
+func serveAdmin(path string, requests chan<- *admin_request) error {
+	// clear out any socket left behind by a previous run
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Error accepting admin connection: %v", err)
+				return
+			}
+			go handleAdminConn(conn, requests)
+		}
+	}()
+	return nil
+}
+
+// reads commands from the passed in connection, one per line, writing back each reply
+func handleAdminConn(conn net.Conn, requests chan<- *admin_request) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			return
+		}
+
+		request := &admin_request{command: fields[0], args: fields[1:], reply: make(chan string, 1)}
+		requests <- request
+		fmt.Fprintln(conn, <-request.reply)
+	}
+}
+
+// handles the passed in admin command against our current hosts, returning our reply, reload is
+// handled by our main loop itself
+func adminCommand(request *admin_request, hosts []*host_config) string {
+	switch request.command {
+	case "status":
+		lines := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			line := fmt.Sprintf("%s %s %s", host.hostname, host.status(), strings.Join(host.ip_addresses, ","))
+			if !host.last_success.IsZero() {
+				line += fmt.Sprintf(" (last success %s)", host.last_success.Format(time.RFC3339))
+			}
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		return strings.Join(lines, "\n")
+
+	case "resolve":
+		if len(request.args) != 1 {
+			return "usage: resolve <hostname>"
+		}
+		for _, host := range hosts {
+			if host.hostname == request.args[0] {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				result, server, err := lookupHost(ctx, host)
+				if err != nil && !errors.Is(err, ERR_NO_RECORD) {
+					return fmt.Sprintf("%s = %s (%v)", host.hostname, ERROR, err)
+				}
+				if result.ip_address == MISSING {
+					return fmt.Sprintf("%s = %s (%v via %s)", host.hostname, MISSING, result.rtt, server)
+				}
+				return fmt.Sprintf("%s = %s (%v via %s)", host.hostname, strings.Join(result.ip_addresses, ","), result.rtt, server)
+			}
+		}
+		return fmt.Sprintf("%s is not configured", request.args[0])
+
+	default:
+		return "commands: status, resolve <hostname>, reload, confirm, quit"
+	}
+}
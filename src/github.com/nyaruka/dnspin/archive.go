@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the format of the timestamps our archived copies are named with, which sort in the order they were taken
+const ARCHIVE_TIMESTAMP = "20060102T150405.000000000Z"
+
+// copies the passed in file to our archive directory, named with the current time, removing the oldest copies
+// beyond how many we keep
+func archiveFile(path string, dir string, keep int) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	prefix := filepath.Base(path) + "."
+	err = os.WriteFile(filepath.Join(dir, prefix+time.Now().UTC().Format(ARCHIVE_TIMESTAMP)), contents, 0644)
+	if err != nil {
+		return err
+	}
+	if keep <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	archived := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			archived = append(archived, entry.Name())
+		}
+	}
+	sort.Strings(archived)
+
+	for len(archived) > keep {
+		err = os.Remove(filepath.Join(dir, archived[0]))
+		if err != nil {
+			return err
+		}
+		archived = archived[1:]
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// appends a line to our changelog for each host whose addresses differ from the current mappings
+func appendChangelog(path string, hosts []*host_config, current_mappings map[string][]string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	lines := make([]string, 0)
+
+	pinned := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		pinned[host.hostname] = true
+
+		// zones are logged by each name in them, keeping their cached names if we failed to transfer them or
+		// haven't yet
+		if host.axfr {
+			for name := range current_mappings {
+				if inZone(host, name) && (host.ip_address == ERROR || host.ip_address == NIL) {
+					pinned[name] = true
+				}
+			}
+			for name, ip_addresses := range host.zone_entries {
+				pinned[name] = true
+				if host.ip_address == ZONE && !slices.Equal(current_mappings[name], ip_addresses) {
+					lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%s", now, name, changelogIPs(current_mappings[name]), changelogIPs(ip_addresses)))
+				}
+			}
+			continue
+		}
+
+		// hosts we failed to look up or haven't looked up yet keep their cached value, as do missing hosts if configured to
+		if host.ip_address == ERROR || host.ip_address == NIL || (host.ip_address == MISSING && host.keep_missing) {
+			continue
+		}
+
+		old := current_mappings[host.hostname]
+		if !slices.Equal(old, host.ip_addresses) {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%s", now, host.hostname, changelogIPs(old), changelogIPs(host.ip_addresses)))
+		}
+	}
+
+	// and any hosts which are no longer pinned at all
+	for hostname, old := range current_mappings {
+		if !pinned[hostname] {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%s", now, hostname, changelogIPs(old), "-"))
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return w.Flush()
+}
+
+// formats a list of addresses for our changelog, using - for none
+func changelogIPs(ip_addresses []string) string {
+	if len(ip_addresses) == 0 {
+		return "-"
+	}
+	return strings.Join(ip_addresses, ",")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// checks the integrity of the DNSPIN block in the passed in hosts file, printing any problems found
+// and returning the exit code for the check-hosts command
+func checkHostsFile(path string) int {
+	problems, err := findBlockProblems(path)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", path, err)
+		return 2
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: DNSPIN block OK\n", path)
+		return 0
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", path, problem)
+	}
+	return 1
+}
+
+// returns a description of each problem with the markers or entries of our block
+func findBlockProblems(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(strings.Split(string(contents), "\n"), DNSPIN_BEGIN) {
+		return []string{"missing BEGIN marker"}, nil
+	}
+
+	// these are the same problems we'd repair when next writing the file, though without our config we can't
+	// tell where a block missing its END marker ends so don't check its entries
+	_, pin_lines, _, problems, err := readHostsFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range pin_lines {
+		problem := checkBlockEntry(line)
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", problem, line))
+		}
+	}
+	return problems, nil
+}
+
+// returns what's wrong with the passed in entry from inside our block, or an empty string if nothing is
+func checkBlockEntry(line string) string {
+	if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+		return ""
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "malformed entry"
+	}
+	if net.ParseIP(fields[0]) == nil {
+		return "invalid IP address"
+	}
+	return ""
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFindBlockProblems(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		problems []string
+	}{
+		{name: "ok", lines: []string{"127.0.0.1 localhost", DNSPIN_BEGIN, "10.0.0.1\ta.example.com", DNSPIN_END}, problems: []string{}},
+		{name: "no block", lines: []string{"127.0.0.1 localhost"}, problems: []string{"missing BEGIN marker"}},
+		{name: "bad entries", lines: []string{DNSPIN_BEGIN, "# a comment", "10.0.0.1", "nope a.example.com", DNSPIN_END}, problems: []string{"malformed entry: 10.0.0.1", "invalid IP address: nope a.example.com"}},
+		{
+			name:     "bad markers",
+			lines:    []string{DNSPIN_END, DNSPIN_BEGIN, "10.0.0.1\ta.example.com", DNSPIN_END, DNSPIN_BEGIN, "10.0.0.2\ta.example.com", DNSPIN_END},
+			problems: []string{"line 1: END marker without a BEGIN", "line 5: more than one block", "1 lines in extra blocks"},
+		},
+		{name: "missing END", lines: []string{DNSPIN_BEGIN, "10.0.0.1\ta.example.com"}, problems: []string{"missing END marker"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems, err := findBlockProblems(writeTestHosts(t, test.lines...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(problems, test.problems) {
+				t.Errorf("got %q, expected %q", problems, test.problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// a host in a YAML or JSON config, options are the same as in our line format, with true for options
+// without a value
+type config_entry struct {
+	Hostname string            `json:"hostname" yaml:"hostname"`
+	Server   string            `json:"server" yaml:"server"`
+	Options  map[string]any    `json:"options" yaml:"options"`
+	Tags     map[string]string `json:"tags" yaml:"tags"`
+}
+
+// returns the format of the passed in config source from its extension, which is conf unless it's yaml or json
+func configFormat(source string) string {
+	if parsed, err := url.Parse(source); err == nil && parsed.Scheme != "" {
+		source = parsed.Path
+	}
+
+	switch strings.ToLower(path.Ext(source)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	default:
+		return "conf"
+	}
+}
+
+// parses our host config from the passed in reader in the format of the passed in source
+func parseConfig(r io.Reader, source string) ([]*host_config, error) {
+	format := configFormat(source)
+	if format == "conf" {
+		return parseHostConfig(r)
+	}
+
+	entries := make([]config_entry, 0)
+	var err error
+	if format == "json" {
+		err = json.NewDecoder(r).Decode(&entries)
+	} else {
+		err = yaml.NewDecoder(r).Decode(&entries)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return make([]*host_config, 0), errors.New(fmt.Sprintf("Invalid %s config: %v", format, err))
+	}
+
+	// each entry becomes a line in our line format, so they are validated in exactly the same way
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		line, err := entry.line()
+		if err != nil {
+			return make([]*host_config, 0), errors.New(fmt.Sprintf("Invalid host %d: %v", i+1, err))
+		}
+		lines[i] = line
+	}
+	return parseHostConfig(strings.NewReader(strings.Join(lines, "\n")))
+}
+
+// returns this entry as a line of our line format
+func (e config_entry) line() (string, error) {
+	server := e.Server
+	if server == "" {
+		server = SYSTEM
+	}
+	fields := []string{e.Hostname, server}
+
+	options := make([]string, 0, len(e.Options)+len(e.Tags))
+	for key, value := range e.Options {
+		switch value := value.(type) {
+		case bool:
+			if value {
+				options = append(options, key)
+			}
+		case nil:
+			options = append(options, key)
+		default:
+			options = append(options, fmt.Sprintf("%s=%v", key, value))
+		}
+	}
+	for name, value := range e.Tags {
+		options = append(options, fmt.Sprintf("tag.%s=%s", name, value))
+	}
+	sort.Strings(options)
+	fields = append(fields, options...)
+
+	for _, field := range fields {
+		if field == "" || strings.ContainsAny(field, " \t\n") {
+			return "", errors.New(fmt.Sprintf("invalid value %q", field))
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
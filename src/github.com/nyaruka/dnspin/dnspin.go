@@ -10,227 +10,2578 @@ import (
 	"strings"
 	"io/ioutil"
 	"time"
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"os/signal"
+	"syscall"
+	"path/filepath"
+	"net"
+	"strconv"
+	"sort"
+	"bytes"
+	"slices"
+	"context"
 )
 
 type host_config struct {
-	hostname    string
-	dns_server  string
-	ip_address  string
+	hostname            string
+	dns_server          string
+	config              string
+	ip_address          string
+	ip_addresses        []string
+	rtt                 time.Duration
+	answered_by         string
+	ttl                 uint32
+	next_query          time.Time
+	last_success        time.Time
+	changed_on          time.Time
+	enabled             bool
+	required            bool
+	max_ips             int
+	selection           string
+	rotation            int
+	min_answers         int
+	query_class         uint16
+	query_name          string
+	fallback            string
+	verify_server       string
+	fastest             bool
+	cname_aliases       bool
+	aliases             []string
+	conflicted          bool
+	keep_missing        bool
+	axfr                bool
+	zone_entries        map[string][]string
+	single_ip           bool
+	prefer              string
+	prefer_cidrs        []*net.IPNet
+	query_types         []uint16
+	healthcheck_port    string
+	healthcheck_timeout time.Duration
+	cooldown            time.Duration
+	timeout             time.Duration
+	tags                map[string]string
+	from_names          bool
+	shown_ttl           uint32
+}
+
+// the result of a single lookup against a DNS server
+type lookup_result struct {
+	ip_address   string
+	ip_addresses []string
+	ttl          uint32
+	rtt          time.Duration
+	answers      int
+	answer_ips   []string
+	aliases      []string
 }
 
 const NIL = "NIL"
 const ERROR = "ERROR"
 const MISSING = "MISSING"
+const ZONE = "ZONE"
+const SYSTEM = "system"
 
 const DNSPIN_BEGIN    = "### DNSPIN BEGIN ###"
 const DNSPIN_END      = "### DNSPIN END #####"
 
+var config_source = flag.String("config", "dnspin.conf", "path or http(s) URL of the config to load")
+var empty_config = flag.String("empty-config", "warn", "what to do when the config has no hosts: warn and leave existing entries alone, or exit")
+var config_refresh = flag.Duration("config-refresh", 0, "how often to reload the config, e.g. 5m (disabled when zero)")
+var hosts_file = flag.String("hosts-file", "/etc/hosts", "hosts file to pin entries in (disabled when empty)")
+var dnsmasq_file = flag.String("dnsmasq-file", "", "dnsmasq addn-hosts file to also write entries to (disabled when empty)")
+var show_source = flag.Bool("show-source", false, "write a comment with the DNS server which answered before each entry")
+var max_failure_ratio = flag.Float64("max-failure-ratio", 1.0, "skip writing when more than this fraction of hosts fail to resolve, e.g. 0.5")
+var changelog_path = flag.String("changelog", "", "file to append a line to for every changed address in the hosts file (disabled when empty)")
+var import_block = flag.String("import-block", "", "begin marker of another tool's block whose entries to adopt when we have no block yet")
+var import_block_end = flag.String("import-block-end", "", "end marker of the imported block (defaults to the first empty line)")
+var lock_path = flag.String("lock-file", "", "file to hold an exclusive flock on while updating the hosts file, e.g. /etc/hosts.lock (disabled when empty)")
+var lock_timeout = flag.Duration("lock-timeout", 10*time.Second, "how long to wait for the lock file before giving up on a write")
+var separator = flag.String("separator", "tab", "separator between addresses and names in written entries: tab, space or aligned")
+var permission_backoff = flag.Duration("permission-backoff", 5*time.Minute, "maximum time to back off retrying a target we aren't permitted to write (disabled when zero)")
+var show_ttl = flag.Bool("show-ttl", false, "write a comment with the TTL of the answer before each entry, as first seen for its current addresses")
+var remove_duplicates = flag.Bool("remove-duplicates", false, "remove entries for our hosts found outside our block in the hosts file")
+var force_newline = flag.Bool("force-newline", false, "always end the hosts file with a newline instead of preserving how it ended")
+var short_names = flag.Bool("short-names", false, "also write the short name (first label) of each hostname in its entries")
+var temp_dir = flag.String("temp-dir", "", "directory to write temp files in, must be on the same filesystem as the hosts file (defaults to its directory)")
+var warmup = flag.Duration("warmup", 0, "how long to wait at startup for a host to resolve to an address before the first write, e.g. 30s (disabled when zero)")
+var warmup_exit = flag.Bool("warmup-exit", false, "exit instead of proceeding if no hosts resolve during the warm-up")
+var log_path = flag.String("log-file", "", "file to write logs to, reopened on SIGHUP (defaults to stderr)")
+var run_as = flag.String("user", "", "user to drop privileges to once started (defaults to staying as the current user)")
+var state_path = flag.String("state-file", "", "file to write our state to as JSON on SIGUSR1 (defaults to stderr)")
+var admin_socket = flag.String("admin-socket", "", "UNIX socket to accept status, resolve and reload commands on (disabled when empty)")
+var metrics_addr = flag.String("metrics-addr", "", "address to serve Prometheus metrics and /healthz on, e.g. :9153 (disabled when empty)")
+var canary = flag.String("canary", "", "configured host which must resolve for /healthz to report healthy")
+var check_ptr = flag.Bool("check-ptr", false, "warn when the PTR record of a resolved IP doesn't map back to its hostname")
+var strict_ptr = flag.Bool("strict-ptr", false, "treat hosts failing the PTR check as errors (implies --check-ptr)")
+var allow_link_local = flag.Bool("allow-link-local", false, "allow pinning link-local addresses")
+var max_ips = flag.Int("max-ips", 1, "maximum number of addresses to pin per host, can be overridden per host with max-ips=N")
+var resolv_conf = flag.String("resolv-conf", "/etc/resolv.conf", "resolver config to use for hosts configured without a DNS server")
+var rotate_resolvers = flag.Bool("rotate-resolvers", false, "rotate which resolv.conf nameserver is tried first on each lookup")
+var query_class_name = flag.String("query-class", "IN", "DNS class to query, can be overridden per host with class=CLASS")
+var strict_single_ip = flag.Bool("strict-single-ip", false, "treat hosts with more than one A record as errors, can be enabled per host with single-ip")
+var server_qps = flag.Float64("server-qps", 0, "maximum queries per second to send to each DNS server (unlimited when zero)")
+var server_qps_overrides = flag.String("server-qps-overrides", "", "per server query limits as server=qps,server=qps")
+var cycle_timeout = flag.Duration("cycle-timeout", 0, "maximum time to spend looking up hosts each cycle, including waiting on rate limits (unlimited when zero)")
+var dns_net = flag.String("dns-net", "", "network to send DNS queries over: udp4, udp6, tcp4 or tcp6 to pin the address family, tcp-tls for DNS over TLS or quic for DNS over QUIC (defaults to udp over either)")
+var udp_size = flag.Int("udp-size", 0, "EDNS0 UDP buffer size to advertise and read answers with, 1232 is a safe choice for large answers (defaults to 512 without EDNS0)")
+var outage_backoff = flag.Duration("outage-backoff", 5*time.Minute, "maximum interval to back off to while no lookups succeed (disabled when zero)")
+var outage_backoff_factor = flag.Float64("outage-backoff-factor", 2, "factor to grow the interval by each cycle that no lookups succeed")
+var tls_cert = flag.String("tls-cert", "", "client certificate to present for DNS over TLS or QUIC")
+var tls_key = flag.String("tls-key", "", "key for the client certificate used for DNS over TLS or QUIC")
+var tls_ca = flag.String("tls-ca", "", "CA bundle to verify DNS over TLS or QUIC servers with (defaults to the system roots)")
+var tls_server_name = flag.String("tls-server-name", "", "name to verify DNS over TLS or QUIC server certificates against (defaults to the server address)")
+var disable_pinning = flag.Bool("disable-pinning", false, "keep looking up hosts but remove our block from the hosts file and pin nothing")
+var pin_resolvers = flag.Bool("pin-resolvers", false, "also pin the addresses of DNS servers configured by name, looking them up using the system resolvers")
+var max_hosts_size = flag.Int64("max-hosts-size", 10*1024*1024, "refuse to rewrite a hosts file larger than this many bytes (unlimited when zero)")
+var skip_bad_lines = flag.Bool("skip-bad-lines", false, "log and skip invalid config lines instead of failing to load the config")
+var show_previous = flag.Bool("show-previous", false, "add a comment with the previous addresses of a host for the cycle its addresses change")
+var watch_config = flag.Bool("watch-config", false, "reload the config file whenever it changes, as well as on SIGHUP")
+var group_by = flag.String("group-by", "", "group entries under a comment header by server or by a tag as tag.NAME")
+var edns_id = flag.String("edns-id", "", "identify our queries to resolvers with this value in a local EDNS0 option (code 65001)")
+var min_write_interval = flag.Duration("min-write-interval", 0, "rewrite each target at most once per this interval, writing any changes in between once it's up")
+var change_cooldown = flag.Duration("change-cooldown", 0, "keep the addresses of a host for this long after they change, can be set per host with cooldown=D (disabled when zero)")
+var prefer_cidrs_spec = flag.String("prefer-cidrs", "", "comma separated networks to prefer pinning addresses in, in order, can be set per host with prefer-cidrs=")
+var verify_writes = flag.Bool("verify-writes", false, "reread the hosts file after writing it and log an error if our block isn't what we wrote")
+var local_subnets_only = flag.Bool("local-subnets-only", false, "only pin addresses on the networks of this machine's interfaces, keeping the previous value otherwise")
+var failed_path = flag.String("failed-file", "", "file to write the hosts which currently fail to resolve or have no records to each cycle, one per line")
+var log_timestamps = flag.String("log-timestamps", "default", "how to timestamp log lines: default, rfc3339 or none")
+var max_removed = flag.Int("max-removed", 0, "refuse to remove more than this many entries in one write without confirmation (unlimited when zero)")
+var max_removed_ratio = flag.Float64("max-removed-ratio", 0, "refuse to remove more than this fraction of our entries in one write without confirmation (unlimited when zero)")
+var force = flag.Bool("force", false, "allow our first write to remove more entries than --max-removed or --max-removed-ratio")
+var validate_command = flag.String("validate-command", "", "command to run with each new hosts file as its last argument, which must exit zero for the file to be used")
+var env_file = flag.String("env-file", "", "env file to also write the first address of each host to as DNSPIN_NAME=IP")
+var dns_timeout = flag.Duration("dns-timeout", 2*time.Second, "how long to wait for an answer to each query, can be set per host with timeout=D")
+var block_footer = flag.Bool("footer", false, "end our block with a comment noting our version, when it was written and how many entries it has")
+var reload_changed_only = flag.Bool("reload-changed-only", false, "on reload only look up new or changed hosts right away, keeping the state of the others")
+var reject_mapped = flag.Bool("reject-mapped", false, "ignore IPv4-mapped IPv6 addresses in AAAA answers instead of pinning their IPv4 form")
+var os_resolver = flag.Bool("os-resolver", false, "resolve hosts configured without a DNS server as the system would, rather than querying its resolvers ourselves")
+var names_file = flag.String("names-file", "", "file listing further hostnames to look up, one per line, reread each cycle (disabled when empty)")
+var names_server = flag.String("names-server", SYSTEM, "DNS server to look up the hostnames in --names-file with")
+var external_conflicts = flag.String("external-conflicts", "warn", "what to do about entries outside our block mapping our hosts to other addresses: warn, or comment them out")
+var max_lookups = flag.Int("max-lookups-per-cycle", 0, "look up at most this many hosts each cycle, continuing with the rest in the next cycles (unlimited when zero)")
+var comment_char = flag.String("comment-char", "#", "character to start our comments with in the dnsmasq file, for parsers which don't treat # as a comment")
+var archive_dir = flag.String("archive-dir", "", "directory to archive a timestamped copy of the hosts file to whenever we change it (disabled when empty)")
+var archive_keep = flag.Int("archive-keep", 100, "how many archived copies of the hosts file to keep, the oldest are removed (unlimited when zero)")
+var respect_ttl = flag.Bool("respect-ttl", false, "don't requery a host until the TTL of its last answer has elapsed")
+
+// our version, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// the networks we prefer pinning addresses in by default, parsed from --prefer-cidrs
+var prefer_cidrs []*net.IPNet
+
+// the class we query by default, parsed from --query-class
+var query_class uint16 = dns.ClassINET
+
+// how often we look up our hosts
+const CYCLE_INTERVAL = 5 * time.Second
+
+// the EDNS0 option code we identify ourselves with, the first of those reserved for local use
+const EDNS_ID_CODE = 65001
+
 const PRE_PIN  = 0
 const IN_PIN   = 1
 const POST_PIN = 2
 
-func lookupIP(host string, server string) (string, error) {
-	c := dns.Client{}
-	m := dns.Msg{}
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
-	r, _, err := c.Exchange(&m, server+":53")
-	if err != nil {
-		return "", err
+// the schemes a server can be given with to choose how we query it, mapped to the network we use
+var server_schemes = map[string]string{"udp": "udp", "tcp": "tcp", "tls": "tcp-tls", "quic": "quic", "https": "https"}
+
+// returns the network to query the passed in server over and its address, servers without a scheme use
+// --dns-net and DNS over HTTPS servers are addressed by their full URL
+func serverTransport(server string) (network string, address string) {
+	scheme, rest, found := strings.Cut(server, "://")
+	if !found {
+		return *dns_net, server
 	}
-	for _, ans := range r.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			return a.A.String(), nil
+	if scheme == "https" {
+		return "https", server
+	}
+	return server_schemes[scheme], rest
+}
+
+// checks that the passed in server has a scheme we support and an address, or that each of a comma
+// separated list of servers does
+func checkServer(server string) error {
+	if strings.Contains(server, ",") {
+		for _, part := range strings.Split(server, ",") {
+			if part == "" || part == SYSTEM || strings.Contains(part, ",") {
+				return errors.New(fmt.Sprintf("invalid server list %s", server))
+			}
+			if err := checkServer(part); err != nil {
+				return err
+			}
 		}
+		return nil
 	}
 
-	// we reached the server and it has no record
-	return MISSING, nil
+	scheme, rest, found := strings.Cut(server, "://")
+	if !found {
+		return nil
+	}
+	if _, exists := server_schemes[scheme]; !exists {
+		return errors.New(fmt.Sprintf("unknown server scheme %s in %s, must be udp, tcp, tls, quic or https", scheme, server))
+	}
+	if serverHost(server) == "" || (scheme != "https" && strings.Contains(rest, "/")) {
+		return errors.New(fmt.Sprintf("invalid server %s", server))
+	}
+	return nil
 }
 
-func loadHostConfig(filename string) (hosts []*host_config, err error){
-	hosts = make([]*host_config, 0, 5)
-
-	f, err := os.Open(filename)
-	if err != nil {
-		return hosts, err
+// returns the host of the passed in server, without any scheme, port or path
+func serverHost(server string) string {
+	if strings.HasPrefix(server, "https://") {
+		parsed, err := url.Parse(server)
+		if err != nil {
+			return ""
+		}
+		return parsed.Hostname()
 	}
-	defer f.Close()
 
-	lineno := 0
+	_, host := serverTransport(server)
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return host
+}
 
-	// scan the file line by line
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		lineno += 1
-		line := scanner.Text()
+// returns the address to send queries for the passed in server to over the passed in network, which is
+// port 53 (or 853 for DNS over TLS or QUIC) unless it includes a port
+func serverAddress(server string, network string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	if network == "tcp-tls" || network == "quic" {
+		return net.JoinHostPort(server, "853")
+	}
+	return net.JoinHostPort(server, "53")
+}
 
-		if len(line) > 0 && !strings.HasPrefix(line, "#") {
-			// now split our line into two parts, hostname and dns server
-			fields := strings.Fields(line)
-			if len(fields) != 2 {
-				return hosts, errors.New(fmt.Sprintf("Unexpected input on line %d: %s", lineno, line))
+// returns whether the passed in value is a server IP address, optionally with a port, or a server with a scheme
+func isServerAddress(value string) bool {
+	if strings.Contains(value, ",") {
+		for _, part := range strings.Split(value, ",") {
+			if !isServerAddress(part) {
+				return false
 			}
+		}
+		return true
+	}
+	if strings.Contains(value, "://") {
+		return checkServer(value) == nil
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	return net.ParseIP(value) != nil
+}
 
-			// save away to our config
-			hosts = append(hosts, &host_config{fields[0], fields[1], NIL})
+// sends a single query for the passed in name and type to the server
+func exchange(ctx context.Context, name string, qtype uint16, qclass uint16, server string, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	// wait our turn if queries to this server are rate limited
+	if limiter := serverLimiter(server); limiter != nil {
+		err := limiter.Wait(ctx)
+		if err != nil {
+			return nil, 0, withKind(err, ERR_TIMEOUT)
 		}
 	}
 
-	return hosts, nil
-}
+	// our timeout starts once we're allowed to send our query
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-func writeHostsFile(hosts []*host_config) (wrote bool, err error) {
-	// first read in our current hosts file
-	in, err := os.Open("/etc/hosts")
+	network, address := serverTransport(server)
+	c := dns.Client{Net: network, TLSConfig: tls_config, Timeout: timeout}
+	m := dns.Msg{}
+	m.SetQuestion(name, qtype)
+	m.Question[0].Qclass = qclass
+
+	// advertise a larger buffer so big answers aren't truncated, TCP messages are length prefixed and
+	// so always read in full
+	if *udp_size > 0 {
+		c.UDPSize = uint16(*udp_size)
+		m.SetEdns0(uint16(*udp_size), false)
+	}
+
+	// identify ourselves to resolver operators with a local EDNS0 option if asked to
+	if *edns_id != "" {
+		if m.IsEdns0() == nil {
+			m.SetEdns0(dns.MinMsgSize, false)
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS_ID_CODE, Data: []byte(*edns_id)})
+	}
+	var r *dns.Msg
+	var rtt time.Duration
+	var err error
+	switch network {
+	case "quic":
+		r, rtt, err = exchangeQUIC(ctx, &m, serverAddress(address, network))
+	case "https":
+		r, rtt, err = exchangeHTTPS(ctx, &m, address)
+	default:
+		r, rtt, err = c.ExchangeContext(ctx, &m, serverAddress(address, network))
+	}
 	if err != nil {
-		return false, err
+		kind := errorKind(err)
+		if network == "tcp-tls" {
+			err = errors.New(fmt.Sprintf("DNS over TLS to %s failed, check its certificate and our client certificate: %v", server, err))
+		} else if network == "https" {
+			err = errors.New(fmt.Sprintf("DNS over HTTPS to %s failed: %v", server, err))
+		} else if network == "quic" {
+			err = errors.New(fmt.Sprintf("DNS over QUIC to %s failed, check it supports DoQ on this port: %v", server, err))
+		}
+		return nil, 0, withKind(err, kind)
 	}
-	defer in.Close()
+	lookup_duration.WithLabelValues(server).Observe(rtt.Seconds())
 
-	pre_lines  := make([]string, 0, 10)
-	pin_lines  := make([]string, 0, 10)
-	post_lines := make([]string, 0, 10)
+	return r, rtt, nil
+}
 
-	location := PRE_PIN
+// looks up the host against the server, trying each of its record types in order of preference until one has addresses.
+// If the server tells us the name doesn't exist we return a MISSING result along with an ERR_NO_RECORD error, so it
+// can be told apart from a name which exists without any addresses.
+func lookupIP(ctx context.Context, host *host_config, server string) (*lookup_result, error) {
+	if server == OS {
+		return lookupOS(ctx, host)
+	}
+	if len(host.query_types) > 0 {
+		return lookupTypes(ctx, host, server)
+	}
 
-	scanner := bufio.NewScanner(in)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if (line == DNSPIN_BEGIN) {
-			location = IN_PIN
-		} else if (line == DNSPIN_END){
-			location = POST_PIN
-		} else {
-			if (location == PRE_PIN) {
-				pre_lines = append(pre_lines, line)
-			} else if (location == IN_PIN) {
-				if !strings.HasPrefix(line, "#") {
-					pin_lines = append(pin_lines, line)
-				}
-			} else if (location == POST_PIN) {
-				pin_lines = append(post_lines, line)
-			}
+	var result *lookup_result
+	for _, qtype := range host.queryTypes() {
+		var err error
+		result, err = lookupType(ctx, host, server, qtype)
+		if err != nil || result.ip_address != MISSING {
+			return result, err
 		}
 	}
+	return result, nil
+}
 
-	// parse our current mappings
-	current_mappings := make(map[string]string)
-	for _, line := range(pin_lines) {
-		fields := strings.Fields(line)
+// looks up every record type configured for the host against the server, returning the union of their addresses
+func lookupTypes(ctx context.Context, host *host_config, server string) (*lookup_result, error) {
+	union := &lookup_result{ip_address: MISSING}
+	for _, qtype := range host.query_types {
+		result, err := lookupType(ctx, host, server, qtype)
+		if err != nil {
+			return result, err
+		}
+		union.rtt += result.rtt
+		if result.ip_address == MISSING {
+			continue
+		}
 
-		// if this line is a host mapping, save it
-		if len(fields) == 2 {
-			current_mappings[fields[1]] = fields[0]
+		if union.ip_address == MISSING || result.ttl < union.ttl {
+			union.ttl = result.ttl
+		}
+		if union.ip_address == MISSING {
+			union.ip_address = result.ip_address
+		}
+		for _, ip_address := range result.ip_addresses {
+			if !slices.Contains(union.ip_addresses, ip_address) {
+				union.ip_addresses = append(union.ip_addresses, ip_address)
+			}
+		}
+		union.answers += result.answers
+		for _, ip_address := range result.answer_ips {
+			if !slices.Contains(union.answer_ips, ip_address) {
+				union.answer_ips = append(union.answer_ips, ip_address)
+			}
+		}
+		for _, alias := range result.aliases {
+			if !slices.Contains(union.aliases, alias) {
+				union.aliases = append(union.aliases, alias)
+			}
 		}
 	}
+	return union, nil
+}
 
-	// are there any changes? to be made
-	needs_rewrite := len(current_mappings) != len(hosts)
-	for _, host := range(hosts){
-		ip_address, exists := current_mappings[host.hostname]
-		if !exists || ip_address != host.ip_address {
-			needs_rewrite = true
-			break
+func lookupType(ctx context.Context, host *host_config, server string, qtype uint16) (*lookup_result, error) {
+	r, rtt, err := exchange(ctx, dns.Fqdn(host.queryName()), qtype, host.queryClass(), server, host.dnsTimeout())
+	if err != nil {
+		return nil, err
+	}
+
+	// the name doesn't exist at all, rather than just not having any records of this type
+	if r.Rcode == dns.RcodeNameError {
+		err := withKind(errors.New(fmt.Sprintf("%s does not exist via %s", host.queryName(), server)), ERR_NO_RECORD)
+		return &lookup_result{ip_address: MISSING, rtt: rtt}, err
+	}
+
+	ips := make([]net.IP, 0, len(r.Answer))
+	var ttl uint32
+	for _, ans := range r.Answer {
+		var ip net.IP
+		switch rr := ans.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		if ans.Header().Rrtype != qtype {
+			continue
+		}
+		if !usableIP(ip) {
+			log.Printf("Warning: ignoring unusable address %s for %s", ip, host.hostname)
+			continue
+		}
+
+		// IPv4-mapped IPv6 addresses are written in their IPv4 form unless we reject them
+		if qtype == dns.TypeAAAA && ip.To4() != nil {
+			if *reject_mapped {
+				log.Printf("Warning: ignoring IPv4-mapped address ::ffff:%s for %s", ip, host.hostname)
+				continue
+			}
+			ip = ip.To4()
+		}
+		if len(ips) == 0 || ans.Header().Ttl < ttl {
+			ttl = ans.Header().Ttl
 		}
+		ips = append(ips, ip)
 	}
 
-	// no rewrite needed, return
-	if !needs_rewrite {
-		return false, nil
+	// we reached the server and it has no record
+	if len(ips) == 0 {
+		return &lookup_result{ip_address: MISSING, rtt: rtt}, nil
 	}
 
-	// ok, rewrite our hosts file to a tmp file first
-	out, err := ioutil.TempFile("/tmp", "hosts")
-	if err != nil {
-		return false, err
+	return selectResult(host, ips, ttl, rtt, cnameChain(host.queryName(), r.Answer)), nil
+}
+
+// returns the result of a lookup of the passed in host which was answered with the passed in IPs, selecting
+// which of them we pin
+func selectResult(host *host_config, ips []net.IP, ttl uint32, rtt time.Duration, aliases []string) *lookup_result {
+	// every address we were given, before we select which to pin, so we can compare answers from servers
+	answer_ips := make([]string, len(ips))
+	for i, ip := range ips {
+		answer_ips[i] = ip.String()
 	}
-	defer out.Close()
-	defer os.Remove(out.Name())
+	sort.Strings(answer_ips)
 
-	err = out.Chmod(0644)
-	if err != nil {
-		return false, err
+	answers := len(ips)
+	ips = selectIPs(host, ips)
+
+	ip_addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		ip_addresses[i] = ip.String()
 	}
+	return &lookup_result{ip_addresses[0], ip_addresses, ttl, rtt, answers, answer_ips, aliases}
+}
 
-	w := bufio.NewWriter(out)
+// the most CNAMEs we follow from a name, which is plenty for any legitimate chain
+const MAX_CNAME_CHAIN = 8
 
-	// first write lines before our block
-	for _, line := range(pre_lines) {
-		fmt.Fprintln(w, line)
+// returns the names the passed in name is a CNAME of in the passed in answers, in order along the chain
+func cnameChain(name string, answers []dns.RR) []string {
+	targets := make(map[string]string)
+	for _, ans := range answers {
+		if cname, is_cname := ans.(*dns.CNAME); is_cname {
+			targets[strings.ToLower(dns.Fqdn(cname.Hdr.Name))] = strings.ToLower(dns.Fqdn(cname.Target))
+		}
 	}
 
-	// start our block
-	fmt.Fprintln(w, DNSPIN_BEGIN)
+	chain := make([]string, 0)
+	seen := map[string]bool{strings.ToLower(dns.Fqdn(name)): true}
+	current := strings.ToLower(dns.Fqdn(name))
+	for len(chain) < MAX_CNAME_CHAIN {
+		target, exists := targets[current]
+		if !exists || seen[target] {
+			break
+		}
+		seen[target] = true
+		chain = append(chain, strings.TrimSuffix(target, "."))
+		current = target
+	}
+	return chain
+}
 
-	// write our entries
-	for _, host := range(hosts){
-		// we had trouble looking this up, use the old one if it exists
-		if host.ip_address == ERROR {
-			ip_address, exists := current_mappings[host.hostname]
-			if exists {
-				fmt.Fprintf(w, "# %s: cached value, error during lookup to %s\n", host.hostname, host.dns_server)
-				fmt.Fprintf(w, "%s\t%s\n", ip_address, host.hostname)
-			} else {
-				fmt.Fprintf(w, "# %s: error during lookup to %s\n", host.hostname, host.dns_server)
+// sorts the passed in IPs numerically
+func sortIPs(ips []net.IP) {
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+}
+
+// orders the passed in IPs by the first of the passed in networks they are in, with addresses in the same
+// network sorted numerically so our choice is stable, and those in none left last in their current order
+func preferIPs(ips []net.IP, cidrs []*net.IPNet) {
+	rank := func(ip net.IP) int {
+		for i, cidr := range cidrs {
+			if cidr.Contains(ip) {
+				return i
 			}
-		} else if host.ip_address != MISSING {
-			fmt.Fprintf(w, "%s\t%s\n", host.ip_address, host.hostname)
 		}
+		return len(cidrs)
 	}
 
-	// end our block
-	fmt.Fprintln(w, DNSPIN_END)
+	sort.SliceStable(ips, func(i, j int) bool {
+		rank_i, rank_j := rank(ips[i]), rank(ips[j])
+		if rank_i != rank_j {
+			return rank_i < rank_j
+		}
+		return rank_i < len(cidrs) && bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+}
 
-	// write our post block
-	for _, line := range(post_lines) {
-		fmt.Fprintln(w, line)
+// parses a comma separated list of CIDRs
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0)
+	for _, spec := range strings.Split(value, ",") {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid CIDR %s", spec))
+		}
+		cidrs = append(cidrs, cidr)
 	}
-	err = w.Flush()
+	return cidrs, nil
+}
+
+// returns whether the passed in IP is one we can pin, we don't pin unspecified or (by default) link-local addresses
+func usableIP(ip net.IP) bool {
+	if ip.IsUnspecified() {
+		return false
+	}
+	if !*allow_link_local && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+		return false
+	}
+	return true
+}
+
+// formats the passed in IP address for a hosts entry, stripping any zone which isn't valid there
+func entryIP(ip_address string) string {
+	if i := strings.Index(ip_address, "%"); i >= 0 {
+		return ip_address[:i]
+	}
+	return ip_address
+}
+
+// does a reverse lookup of the ip and returns whether any of its PTR records map back to host
+func checkPTR(ctx context.Context, host string, ip string, server string) (bool, error) {
+	if server == OS {
+		return checkOSPTR(ctx, host, ip)
+	}
+
+	reverse, err := dns.ReverseAddr(ip)
 	if err != nil {
 		return false, err
 	}
 
-	// move it atomically over our /etc/hosts file
-	err = os.Rename(out.Name(), "/etc/hosts")
+	r, _, err := exchange(ctx, reverse, dns.TypePTR, dns.ClassINET, server, *dns_timeout)
 	if err != nil {
 		return false, err
 	}
 
-	return true, err
+	for _, ans := range r.Answer {
+		if ptr, ok := ans.(*dns.PTR); ok && strings.EqualFold(ptr.Ptr, dns.Fqdn(host)) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func main() {
-	hosts, err := loadHostConfig("dnspin.conf")
+// loads our host config from the passed in source, which is either a filename or an http(s) URL, in the
+// line format unless it has a .yaml, .yml or .json extension
+func loadHostConfig(source string) (hosts []*host_config, err error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return fetchHostConfig(source)
+	}
+
+	f, err := os.Open(source)
 	if err != nil {
-		log.Fatalf("Error loading dnspin.conf: %v", err)
+		return make([]*host_config, 0), err
 	}
+	defer f.Close()
 
-	for {
-		for _, host := range (hosts) {
-			ip, err := lookupIP(host.hostname, host.dns_server)
+	return parseConfig(f, source)
+}
+
+// fetches our host config from the passed in URL
+func fetchHostConfig(url string) (hosts []*host_config, err error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return make([]*host_config, 0), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return make([]*host_config, 0), errors.New(fmt.Sprintf("Unexpected status fetching %s: %s", url, resp.Status))
+	}
+
+	return parseConfig(resp.Body, url)
+}
+
+// reloads our host config, keeping the current hosts if the new config can't be loaded
+func reloadHostConfig(source string, hosts []*host_config) []*host_config {
+	reloaded, err := loadHostConfig(source)
+	if err != nil {
+		log.Printf("Error reloading %s, keeping current config: %v", source, err)
+		return hosts
+	}
+
+	if len(reloaded) == 0 && *empty_config == "exit" {
+		log.Fatalf("No hosts configured in %s, exiting", source)
+	}
+
+	// pick up any changes to our system resolvers too
+	reloadSystemResolvers()
+
+	updateTagMetrics(reloaded)
+
+	log.Printf("Reloaded %s, %d hosts configured", source, len(reloaded))
+	return reloaded
+}
+
+// returns a host to look up using the passed in server, with our defaults for any options and not yet looked up
+func newHost(hostname string, server string) *host_config {
+	return &host_config{hostname: hostname, dns_server: server, config: hostname + " " + server, ip_address: NIL, enabled: true, healthcheck_timeout: 2 * time.Second}
+}
+
+func parseHostConfig(r io.Reader) (hosts []*host_config, err error){
+	hosts = make([]*host_config, 0, 5)
+
+	lineno := 0
+
+	// the line each hostname was first configured on, and its options
+	seen_lines := make(map[string]int)
+	seen_hosts := make(map[string]*host_config)
+	seen_options := make(map[string]string)
+
+	// whether to skip past the passed in error on a line rather than failing to load
+	skipLine := func(err error) bool {
+		if *skip_bad_lines {
+			log.Printf("Warning: skipping %s", err)
+		}
+		return *skip_bad_lines
+	}
+
+	// scan the file line by line
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineno += 1
+		line := scanner.Text()
+
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			// substitute any environment variables
+			line, err := expandEnv(line)
 			if err != nil {
-				log.Printf("Error: %s", err)
-				host.ip_address = ERROR
-			} else {
-				host.ip_address = ip
+				err = errors.New(fmt.Sprintf("Invalid input on line %d: %v", lineno, err))
+				if skipLine(err) {
+					continue
+				}
+				return hosts, err
+			}
+
+			// now split our line into its parts, hostname, dns server and any options
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				err := errors.New(fmt.Sprintf("Unexpected input on line %d: %s", lineno, line))
+				if skipLine(err) {
+					continue
+				}
+				return hosts, err
+			}
+
+			// a line starting with a server lists hostnames to look up using it, otherwise it's a single host
+			entries := [][]string{fields}
+			if isServerAddress(fields[0]) {
+				if len(fields) < 2 {
+					err := errors.New(fmt.Sprintf("No hostnames for server on line %d: %s", lineno, line))
+					if skipLine(err) {
+						continue
+					}
+					return hosts, err
+				}
+				if option := slices.IndexFunc(fields[1:], isHostOption); option >= 0 {
+					err := errors.New(fmt.Sprintf("Options can't be given for a server on line %d: %s", lineno, fields[option+1]))
+					if skipLine(err) {
+						continue
+					}
+					return hosts, err
+				}
+				entries = make([][]string, 0, len(fields)-1)
+				for _, hostname := range fields[1:] {
+					entries = append(entries, []string{hostname, fields[0]})
+				}
+			}
+
+			for _, fields := range entries {
+				// a hostname on its own is looked up using our system resolvers
+				if len(fields) == 1 {
+					fields = append(fields, SYSTEM)
+				}
+				options := strings.Join(fields[2:], " ")
+
+				// we query fully qualified names anyway, but a trailing dot isn't valid in a hosts file
+				fields[0] = strings.TrimSuffix(fields[0], ".")
+				if fields[0] == "" {
+					err := errors.New(fmt.Sprintf("Invalid hostname on line %d: %s", lineno, line))
+					if skipLine(err) {
+						continue
+					}
+					return hosts, err
+				}
+
+				err := checkServer(fields[1])
+				if err != nil {
+					err = errors.New(fmt.Sprintf("Invalid server on line %d: %v", lineno, err))
+					if skipLine(err) {
+						continue
+					}
+					return hosts, err
+				}
+
+				// have we already seen this host? identical lines are ignored, conflicting ones are an error
+				if seen, exists := seen_hosts[fields[0]]; exists {
+					if seen.dns_server != fields[1] {
+						err := errors.New(fmt.Sprintf("Conflicting servers for %s on lines %d and %d: %s and %s",
+							fields[0], seen_lines[fields[0]], lineno, seen.dns_server, fields[1]))
+						if skipLine(err) {
+							continue
+						}
+						return hosts, err
+					}
+					if seen_options[fields[0]] != options {
+						err := errors.New(fmt.Sprintf("Conflicting options for %s on lines %d and %d",
+							fields[0], seen_lines[fields[0]], lineno))
+						if skipLine(err) {
+							continue
+						}
+						return hosts, err
+					}
+					continue
+				}
+
+				host := newHost(fields[0], fields[1])
+				host.config = strings.Join(fields, " ")
+				err = parseHostOptions(host, fields[2:])
+				if err != nil {
+					err = errors.New(fmt.Sprintf("Invalid option on line %d: %v", lineno, err))
+					if skipLine(err) {
+						continue
+					}
+					return hosts, err
+				}
+
+				// save away to our config
+				hosts = append(hosts, host)
+				seen_hosts[host.hostname] = host
+				seen_lines[host.hostname] = lineno
+				seen_options[host.hostname] = options
 			}
-			log.Printf("%s = %s", host.hostname, host.ip_address)
 		}
+	}
 
-		// rewrite our hosts file
-		wrote, err := writeHostsFile(hosts)
-		if err != nil {
-			log.Printf("Error writing hosts file: %v", err)
-		} else {
-			if wrote {
-				log.Printf("Hosts file updated")
-			} else {
-				log.Printf("No changes, hosts file not updated")
+	// don't act on a partially read config
+	if err := scanner.Err(); err != nil {
+		return hosts, err
+	}
+
+	if *pin_resolvers {
+		hosts = addResolverHosts(hosts)
+	}
+
+	return hosts, nil
+}
+
+// adds a host looked up using our system resolvers for each DNS server configured by name, so that once
+// pinned we can reach our resolvers without needing them to resolve themselves
+func addResolverHosts(hosts []*host_config) []*host_config {
+	resolvers := make([]*host_config, 0)
+	for _, host := range hosts {
+		if host.dns_server == SYSTEM {
+			continue
+		}
+		for _, server := range host.servers() {
+			if server == OS {
+				continue
+			}
+			name := strings.TrimSuffix(serverHost(server), ".")
+			if net.ParseIP(name) != nil || hasHost(hosts, name) || hasHost(resolvers, name) {
+				continue
 			}
+			resolvers = append(resolvers, newHost(name, SYSTEM))
+		}
+	}
+
+	// look up our resolvers before the hosts that depend on them
+	return append(resolvers, hosts...)
+}
+
+// replaces any ${VAR} in the passed in line with the value of that environment variable, $$ can be
+// used for a literal $
+func expandEnv(line string) (string, error) {
+	var expanded strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] != '$' {
+			expanded.WriteByte(line[i])
+			continue
 		}
 
-		// sleep 5 seconds then start all over
-		time.Sleep(5 * time.Second)
+		if strings.HasPrefix(line[i:], "$$") {
+			expanded.WriteByte('$')
+			i += 1
+		} else if strings.HasPrefix(line[i:], "${") {
+			end := strings.IndexByte(line[i:], '}')
+			if end < 0 {
+				return "", errors.New("unterminated ${")
+			}
+			name := line[i+2 : i+end]
+			value, exists := os.LookupEnv(name)
+			if !exists {
+				return "", errors.New(fmt.Sprintf("undefined environment variable %s", name))
+			}
+			expanded.WriteString(value)
+			i += end
+		} else {
+			expanded.WriteByte('$')
+		}
 	}
+	return expanded.String(), nil
+}
+
+// returns whether the passed in config field is one of our host options rather than a hostname
+func isHostOption(field string) bool {
+	return strings.Contains(field, "=") || parseHostOptions(newHost("", SYSTEM), []string{field}) == nil
 }
 
+// applies the trailing options on a config line to the passed in host
+func parseHostOptions(host *host_config, options []string) error {
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+
+		switch key {
+		case "disabled":
+			host.enabled = false
+		case "required":
+			host.required = true
+		case "single-ip":
+			host.single_ip = true
+		case "axfr":
+			host.axfr = true
+		case "fastest":
+			host.fastest = true
+		case "cname-aliases":
+			host.cname_aliases = true
+		case "class":
+			qclass, exists := dns.StringToClass[strings.ToUpper(value)]
+			if !exists {
+				return errors.New(fmt.Sprintf("invalid class %s", value))
+			}
+			host.query_class = qclass
+		case "fallback":
+			if net.ParseIP(value) == nil {
+				return errors.New(fmt.Sprintf("invalid fallback %s", value))
+			}
+			host.fallback = value
+		case "missing":
+			if value != "drop" && value != "keep" {
+				return errors.New(fmt.Sprintf("invalid missing %s, must be drop or keep", value))
+			}
+			host.keep_missing = value == "keep"
+		case "prefer":
+			if value != "v4" && value != "v6" {
+				return errors.New(fmt.Sprintf("invalid prefer %s, must be v4 or v6", value))
+			}
+			host.prefer = value
+		case "types":
+			host.query_types = nil
+			for _, name := range strings.Split(value, ",") {
+				qtype := dns.StringToType[strings.ToUpper(name)]
+				if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+					return errors.New(fmt.Sprintf("invalid types %s, must be A, AAAA or both", value))
+				}
+				if !slices.Contains(host.query_types, qtype) {
+					host.query_types = append(host.query_types, qtype)
+				}
+			}
+		case "query":
+			if value == "" {
+				return errors.New("invalid empty query")
+			}
+			host.query_name = value
+		case "healthcheck":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				return errors.New(fmt.Sprintf("invalid healthcheck port %s", value))
+			}
+			host.healthcheck_port = value
+		case "healthcheck-timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return errors.New(fmt.Sprintf("invalid healthcheck-timeout %s", value))
+			}
+			host.healthcheck_timeout = timeout
+		case "verify":
+			if err := checkServer(value); value == "" || value == SYSTEM || strings.Contains(value, ",") || err != nil {
+				return errors.New(fmt.Sprintf("invalid verify server %s, must be a single server", value))
+			}
+			host.verify_server = value
+		case "selection":
+			if !slices.Contains(selections, value) {
+				return errors.New(fmt.Sprintf("invalid selection %s, must be one of %s", value, strings.Join(selections, ", ")))
+			}
+			host.selection = value
+		case "prefer-cidrs":
+			cidrs, err := parseCIDRs(value)
+			if err != nil {
+				return err
+			}
+			host.prefer_cidrs = cidrs
+		case "min-answers":
+			min_answers, err := strconv.Atoi(value)
+			if err != nil || min_answers < 1 {
+				return errors.New(fmt.Sprintf("invalid min-answers %s", value))
+			}
+			host.min_answers = min_answers
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return errors.New(fmt.Sprintf("invalid timeout %s, must be positive", value))
+			}
+			host.timeout = timeout
+		case "cooldown":
+			cooldown, err := time.ParseDuration(value)
+			if err != nil || cooldown <= 0 {
+				return errors.New(fmt.Sprintf("invalid cooldown %s", value))
+			}
+			host.cooldown = cooldown
+		case "max-ips":
+			max_ips, err := strconv.Atoi(value)
+			if err != nil || max_ips < 1 {
+				return errors.New(fmt.Sprintf("invalid max-ips %s", value))
+			}
+			host.max_ips = max_ips
+		default:
+			// tags are metadata for our logs and metrics and don't change how we look the host up
+			name, is_tag := strings.CutPrefix(key, "tag.")
+			if !is_tag || name == "" {
+				return errors.New(fmt.Sprintf("unknown option %s", option))
+			}
+			if host.tags == nil {
+				host.tags = make(map[string]string)
+			}
+			host.tags[name] = value
+		}
+	}
+
+	if host.prefer != "" && len(host.query_types) > 0 {
+		return errors.New("prefer and types can't be used together")
+	}
+	if host.selection == "cidr" && len(host.preferCIDRs()) == 0 {
+		return errors.New("selection=cidr needs prefer-cidrs")
+	}
+	if host.osResolved() && (host.axfr || host.cname_aliases || host.query_class != 0) {
+		return errors.New("axfr, cname-aliases and class can't be used with the os resolver")
+	}
+	return nil
+}
+
+// leaves out disabled hosts, which aren't pinned, and all hosts if pinning is disabled
+func pinnedHosts(hosts []*host_config) []*host_config {
+	pinned := make([]*host_config, 0, len(hosts))
+	if *disable_pinning {
+		return pinned
+	}
+	for _, host := range hosts {
+		if host.enabled {
+			pinned = append(pinned, host)
+		}
+	}
+	return pinned
+}
+
+// parses the host mappings present in the passed in lines, a host may be mapped to more than one address
+func parseMappings(lines []string) map[string][]string {
+	mappings := make(map[string][]string)
+	for _, line := range(lines) {
+		fields := strings.Fields(line)
+
+		// if this line is a host mapping, save it, any further names on it are aliases
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") {
+			mappings[fields[1]] = append(mappings[fields[1]], fields[0])
+		}
+	}
+	return mappings
+}
+
+// logs the lines removed and added between the old and new versions of a block
+func logDelta(path string, old_lines []string, new_lines []string) {
+	counts := make(map[string]int, len(old_lines))
+	for _, line := range old_lines {
+		counts[line] += 1
+	}
+
+	added := make([]string, 0)
+	for _, line := range new_lines {
+		if counts[line] > 0 {
+			counts[line] -= 1
+		} else {
+			added = append(added, line)
+		}
+	}
+
+	removed := make([]string, 0)
+	for _, line := range old_lines {
+		if counts[line] > 0 {
+			counts[line] -= 1
+			removed = append(removed, line)
+		}
+	}
+
+	log.Printf("Changing %s: %d lines removed, %d lines added", path, len(removed), len(added))
+	for _, line := range removed {
+		log.Printf("  - %s", line)
+	}
+	for _, line := range added {
+		log.Printf("  + %s", line)
+	}
+}
+
+// a line in our block, either a comment or an address and the names it maps to
+type block_line struct {
+	comment    string
+	ip_address string
+	names      []string
+}
+
+func commentLine(format string, args ...any) block_line {
+	return block_line{comment: "# " + fmt.Sprintf(format, args...)}
+}
+
+// returns the passed in lines with any comments starting with the from character starting with the to character
+func commentsWith(lines []string, from string, to string) []string {
+	if from == to {
+		return lines
+	}
+	replaced := make([]string, len(lines))
+	for i, line := range lines {
+		if rest, is_comment := strings.CutPrefix(line, from); is_comment {
+			line = to + rest
+		}
+		replaced[i] = line
+	}
+	return replaced
+}
+
+// returns the passed in addresses as they appear in our entries
+func entryIPs(ip_addresses []string) []string {
+	entries := make([]string, len(ip_addresses))
+	for i, ip_address := range ip_addresses {
+		entries[i] = entryIP(ip_address)
+	}
+	return entries
+}
+
+func entryLine(ip_address string, names ...string) block_line {
+	return block_line{ip_address: entryIP(ip_address), names: names}
+}
+
+// renders the entries for our hosts, falling back to the current mappings for any we had errors looking up
+func renderEntries(hosts []*host_config, current_mappings map[string][]string) []string {
+	if *group_by != "" {
+		hosts = groupHosts(hosts)
+	}
+
+	lines := make([]block_line, 0, len(hosts))
+	for i, host := range(hosts){
+		// start each group with a header if we're grouping our entries
+		if *group_by != "" && (i == 0 || host.group() != hosts[i-1].group()) {
+			lines = append(lines, commentLine("--- %s ---", host.group()))
+		}
+
+		// zones pin every name in them
+		if host.axfr {
+			lines = append(lines, zoneLines(host, current_mappings)...)
+			continue
+		}
+
+		// we haven't looked this up yet, such as when limited in how many we look up each cycle, keep any old one
+		if host.ip_address == NIL {
+			for _, ip_address := range current_mappings[host.hostname] {
+				lines = append(lines, entryLine(ip_address, host.names()...))
+			}
+			continue
+		}
+
+		// we had trouble looking this up, use the old one if it exists
+		if host.ip_address == ERROR {
+			ip_addresses, exists := current_mappings[host.hostname]
+			if exists {
+				lines = append(lines, commentLine("%s: cached value%s, error during lookup to %s", host.hostname, host.cachedSince(), host.dns_server))
+				for _, ip_address := range ip_addresses {
+					lines = append(lines, entryLine(ip_address, host.names()...))
+				}
+			} else if host.fallback != "" {
+				lines = append(lines, commentLine("%s: fallback value, error during lookup to %s", host.hostname, host.dns_server))
+				lines = append(lines, entryLine(host.fallback, host.names()...))
+			} else {
+				lines = append(lines, commentLine("%s: error during lookup to %s", host.hostname, host.dns_server))
+			}
+		} else if host.ip_address == MISSING && host.keep_missing {
+			// this host has no records, but we don't trust that so keep the old value if it exists
+			ip_addresses, exists := current_mappings[host.hostname]
+			if exists {
+				lines = append(lines, commentLine("%s: cached value%s, no records found via %s", host.hostname, host.cachedSince(), host.dns_server))
+				for _, ip_address := range ip_addresses {
+					lines = append(lines, entryLine(ip_address, host.names()...))
+				}
+			}
+		} else if host.ip_address != MISSING {
+			// describe where this entry came from if asked to
+			notes := make([]string, 0, 2)
+			if *show_source {
+				notes = append(notes, fmt.Sprintf("via %s", host.answered_by))
+			}
+			if *show_ttl {
+				notes = append(notes, fmt.Sprintf("ttl=%d", host.shown_ttl))
+			}
+			if len(notes) > 0 {
+				lines = append(lines, commentLine("%s", strings.Join(notes, ", ")))
+			}
+
+			// note what this host was pinned to until now if it just changed, which drops off next cycle
+			if *show_previous {
+				previous, exists := current_mappings[host.hostname]
+				if exists && !slices.Equal(previous, entryIPs(host.ip_addresses)) {
+					lines = append(lines, commentLine("%s: was %s until %s", host.hostname, strings.Join(previous, ","), time.Now().Format(time.RFC3339)))
+				}
+			}
+			for _, ip_address := range host.ip_addresses {
+				lines = append(lines, entryLine(ip_address, host.names()...))
+			}
+		}
+	}
+	return formatLines(lines, *separator)
+}
+
+// describes when a cached value for this host was last looked up, if we know. We don't include its age as
+// that would change our block every cycle.
+func (h *host_config) cachedSince() string {
+	if h.last_success.IsZero() {
+		return ""
+	}
+	return " from " + h.last_success.UTC().Format(time.RFC3339)
+}
+
+// returns the group this host is rendered in when grouping entries, by its server or a tag
+func (h *host_config) group() string {
+	name, is_tag := strings.CutPrefix(*group_by, "tag.")
+	if !is_tag {
+		return "server:" + h.dns_server
+	}
+	value, exists := h.tags[name]
+	if !exists {
+		return name + ":none"
+	}
+	return name + ":" + value
+}
+
+// returns our hosts ordered by their group, keeping the config order within each group so that our
+// block is stable, hosts without the tag we group by come last
+func groupHosts(hosts []*host_config) []*host_config {
+	grouped := slices.Clone(hosts)
+	name, is_tag := strings.CutPrefix(*group_by, "tag.")
+	sort.SliceStable(grouped, func(i, j int) bool {
+		if is_tag {
+			_, i_tagged := grouped[i].tags[name]
+			_, j_tagged := grouped[j].tags[name]
+			if i_tagged != j_tagged {
+				return i_tagged
+			}
+		}
+		return grouped[i].group() < grouped[j].group()
+	})
+	return grouped
+}
+
+// formats our block lines, separating addresses and names with a tab, a space, or aligning names in a column
+func formatLines(lines []block_line, separator string) []string {
+	width := 0
+	for _, line := range lines {
+		if line.comment == "" && len(line.ip_address) > width {
+			width = len(line.ip_address)
+		}
+	}
+
+	formatted := make([]string, len(lines))
+	for i, line := range lines {
+		if line.comment != "" {
+			formatted[i] = line.comment
+			continue
+		}
+
+		names := strings.Join(line.names, " ")
+		switch separator {
+		case "space":
+			formatted[i] = line.ip_address + " " + names
+		case "aligned":
+			formatted[i] = fmt.Sprintf("%-*s %s", width, line.ip_address, names)
+		default:
+			formatted[i] = line.ip_address + "\t" + strings.Join(line.names, "\t")
+		}
+	}
+	return formatted
+}
+
+// returns whether the passed in file ends with a newline, empty files are treated as if they do
+func endsWithNewline(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return true, err
+	}
+
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, info.Size()-1)
+	return last[0] == '\n', err
+}
+
+// how we move our temp files over their targets, replaced in tests to simulate failures
+var rename = os.Rename
+
+// writes the passed in lines to a temp file then moves it over path, ending the last line with a newline
+// only if trailing_newline is set
+func writeAtomically(path string, lines []string, trailing_newline bool) error {
+	// by default we create our temp file next to the target so the rename is atomic, falling back to
+	// there if we can't create it in our temp dir
+	out_dirs := []string{filepath.Dir(path)}
+	if *temp_dir != "" && *temp_dir != out_dirs[0] {
+		out_dirs = append([]string{*temp_dir}, out_dirs...)
+	}
+
+	var out *os.File
+	var err error
+	for i, out_dir := range out_dirs {
+		out, err = ioutil.TempFile(out_dir, filepath.Base(path))
+		if err == nil {
+			break
+		}
+		if i < len(out_dirs)-1 {
+			log.Printf("Warning: unable to create temp file in %s, trying %s: %v", out_dir, out_dirs[i+1], err)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to create a temp file to replace %s, check %s has free space and is writable", path, strings.Join(out_dirs, " or "))
+		return err
+	}
+	defer out.Close()
+	defer os.Remove(out.Name())
+
+	err = out.Chmod(0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	for i, line := range(lines) {
+		if i < len(lines)-1 || trailing_newline {
+			fmt.Fprintln(w, line)
+		} else {
+			fmt.Fprint(w, line)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	// only replace our hosts file if our validation command is happy with it
+	if *validate_command != "" && path == *hosts_file {
+		err = validateFile(out.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	// move it atomically over our target
+	err = rename(out.Name(), path)
+	if errors.Is(err, syscall.EXDEV) {
+		return errors.New(fmt.Sprintf("Unable to move %s over %s, temp dir must be on the same filesystem: %v", out.Name(), path, err))
+	}
+	return err
+}
+
+// reads the passed in hosts file, splitting it into the lines before, inside and after our block, repairing
+// any mismatched markers left by a crash or an older version so that there's only ever a single block, and
+// returning a description of each problem repaired. If our block is missing its END marker, it ends after the
+// last entry for the passed in hosts before any other entry, so that anything added after it is kept.
+func readHostsFile(path string, hosts []*host_config) (pre_lines []string, pin_lines []string, post_lines []string, problems []string, err error) {
+	pre_lines  = make([]string, 0, 10)
+	pin_lines  = make([]string, 0, 10)
+	post_lines = make([]string, 0, 10)
+	problems   = make([]string, 0)
+
+	in, err := os.Open(path)
+	if err != nil {
+		return pre_lines, pin_lines, post_lines, problems, err
+	}
+	defer in.Close()
+
+	location := PRE_PIN
+	lineno := 0
+	blocks := 0
+	dropped := 0
+
+	// the lines of the block we're in, which we only know are ours once we see its END marker
+	block_lines := make([]string, 0, 10)
+	closeBlock := func(lines []string) {
+		if (blocks > 1) {
+			// we keep our first block, later ones are only stale copies of our entries
+			dropped += len(lines)
+		} else {
+			pin_lines = append(pin_lines, lines...)
+		}
+		block_lines = block_lines[:0]
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		lineno += 1
+		line := scanner.Text()
+		if (line == DNSPIN_BEGIN) {
+			if (location == IN_PIN) {
+				problems = append(problems, fmt.Sprintf("line %d: BEGIN marker inside our block", lineno))
+				closeBlock(block_lines)
+			} else if (blocks > 0) {
+				problems = append(problems, fmt.Sprintf("line %d: more than one block", lineno))
+			}
+			blocks += 1
+			location = IN_PIN
+		} else if (line == DNSPIN_END){
+			if (location != IN_PIN) {
+				problems = append(problems, fmt.Sprintf("line %d: END marker without a BEGIN", lineno))
+			} else {
+				closeBlock(block_lines)
+				location = POST_PIN
+			}
+		} else {
+			if (location == PRE_PIN) {
+				pre_lines = append(pre_lines, line)
+			} else if (location == IN_PIN) {
+				block_lines = append(block_lines, line)
+			} else if (location == POST_PIN) {
+				post_lines = append(post_lines, line)
+			}
+		}
+	}
+
+	// if we failed partway we must not write back a truncated copy of the file
+	if err := scanner.Err(); err != nil {
+		return pre_lines, pin_lines, post_lines, problems, err
+	}
+
+	// without an END marker our block ends after the last of our entries before anything else, keeping
+	// everything after that
+	if (location == IN_PIN) {
+		problems = append(problems, "missing END marker")
+		end := 0
+		for i, line := range block_lines {
+			if (isOurEntry(line, hosts)) {
+				end = i + 1
+			} else if (!strings.HasPrefix(line, "#")) {
+				break
+			}
+		}
+		rest := slices.Clone(block_lines[end:])
+		closeBlock(block_lines[:end])
+		post_lines = append(rest, post_lines...)
+	}
+
+	if (dropped > 0) {
+		problems = append(problems, fmt.Sprintf("%d lines in extra blocks", dropped))
+	}
+
+	return pre_lines, pin_lines, post_lines, problems, nil
+}
+
+// returns whether the passed in line is an entry for one of the names of the passed in hosts
+func isOurEntry(line string, hosts []*host_config) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return false
+	}
+	for _, host := range hosts {
+		if (host.axfr && inZone(host, fields[1])) || slices.Contains(host.names(), fields[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// finds the block starting with the passed in begin marker and ending with the end marker (or the first empty
+// line if that is empty), returning the lines before, inside and after it and whether it was found
+func importBlock(lines []string, begin string, end string) ([]string, []string, []string, bool) {
+	start := slices.Index(lines, begin)
+	if start < 0 {
+		return lines, nil, nil, false
+	}
+
+	pin_lines := make([]string, 0, 10)
+	for i := start + 1; i < len(lines); i++ {
+		line := lines[i]
+		if (end != "" && line == end) || (end == "" && strings.TrimSpace(line) == "") {
+			return lines[:start], pin_lines, lines[i+1:], true
+		}
+		if !strings.HasPrefix(line, "#") {
+			pin_lines = append(pin_lines, line)
+		}
+	}
+	return lines[:start], pin_lines, nil, true
+}
+
+// removes our hosts from any entries in the passed in lines, dropping entries left without names, and
+// returns the new lines and how many of our names were removed
+func removeManagedNames(lines []string, hosts []*host_config, path string) ([]string, int) {
+	managed := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		managed[host.hostname] = true
+	}
+
+	kept := make([]string, 0, len(lines))
+	removed := 0
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			kept = append(kept, line)
+			continue
+		}
+
+		// entries can have trailing comments, which we leave alone
+		names := make([]string, 0, len(fields)-1)
+		stray := make([]string, 0)
+		for i, name := range fields[1:] {
+			if strings.HasPrefix(name, "#") {
+				names = append(names, fields[i+1:]...)
+				break
+			}
+			if managed[name] {
+				stray = append(stray, name)
+			} else {
+				names = append(names, name)
+			}
+		}
+
+		if len(stray) == 0 {
+			kept = append(kept, line)
+			continue
+		}
+
+		removed += len(stray)
+		if len(names) == 0 || strings.HasPrefix(names[0], "#") {
+			log.Printf("Removing duplicate entry for %s from %s: %s", strings.Join(stray, ","), path, line)
+		} else {
+			log.Printf("Removing duplicate names %s from entry in %s: %s", strings.Join(stray, ","), path, line)
+			kept = append(kept, fields[0]+"\t"+strings.Join(names, " "))
+		}
+	}
+	return kept, removed
+}
+
+// the entries outside our block we've already warned conflict with ours, so we only warn about each once
+var warned_conflicts = make(map[string]bool)
+
+// finds entries in the passed in lines which map one of our hosts to an address we haven't pinned it to, which
+// makes which one is used ambiguous, warning about them or commenting them out so that ours wins, and returns
+// the new lines and how many were commented out
+func checkExternalConflicts(lines []string, hosts []*host_config, path string) ([]string, int) {
+	pinned := make(map[string]*host_config)
+	for _, host := range pinnedHosts(hosts) {
+		if len(host.ip_addresses) == 0 {
+			continue
+		}
+		for _, name := range host.names() {
+			pinned[name] = host
+		}
+	}
+
+	checked := make([]string, 0, len(lines))
+	commented := 0
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			checked = append(checked, line)
+			continue
+		}
+
+		var conflict *host_config
+		for _, name := range fields[1:] {
+			if strings.HasPrefix(name, "#") {
+				break
+			}
+			host, exists := pinned[name]
+			if exists && !slices.Contains(entryIPs(host.ip_addresses), fields[0]) {
+				conflict = host
+				break
+			}
+		}
+		if conflict == nil {
+			checked = append(checked, line)
+			continue
+		}
+
+		if *external_conflicts == "comment" {
+			log.Printf("Commenting out entry in %s conflicting with ours for %s: %s", path, conflict.hostname, line)
+			checked = append(checked, fmt.Sprintf("# %s # commented out by dnspin, conflicted with %s", line, conflict.hostname))
+			commented += 1
+			continue
+		}
+
+		if !warned_conflicts[line] {
+			log.Printf("Warning: entry in %s conflicts with ours for %s, which one is used is ambiguous: %s", path, conflict.hostname, line)
+			warned_conflicts[line] = true
+		}
+		checked = append(checked, line)
+	}
+	return checked, commented
+}
+
+func writeHostsFile(path string, hosts []*host_config) (wrote bool, err error) {
+	defer func() { err = classifyError(err) }()
+	configured := hosts
+	hosts = pinnedHosts(hosts)
+
+	// hold our lock until we've replaced the file so we don't interleave with other writers
+	if *lock_path != "" {
+		unlock, err := acquireLock(*lock_path, *lock_timeout)
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+	}
+
+	// a hosts file this big is much more likely the wrong file than one we should be rewriting
+	if *max_hosts_size > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		if info.Size() > *max_hosts_size {
+			return false, errors.New(fmt.Sprintf("%s is %d bytes, more than --max-hosts-size of %d, refusing to rewrite it", path, info.Size(), *max_hosts_size))
+		}
+	}
+
+	// we pin nothing, but still need our configured hosts to find the end of a block missing its END marker
+	if *disable_pinning {
+		return removeHostsBlock(path, configured)
+	}
+
+	// first read in our current hosts file
+	pre_lines, pin_lines, post_lines, problems, err := readHostsFile(path, hosts)
+	if err != nil {
+		return false, err
+	}
+	if len(problems) > 0 {
+		log.Printf("WARNING: repairing our block in %s (%s), collapsing it into one", path, strings.Join(problems, ", "))
+	}
+
+	// if we don't have a block yet, adopt the entries of another tool's block if asked to
+	if *import_block != "" && len(pin_lines) == 0 && len(post_lines) == 0 {
+		var imported bool
+		pre_lines, pin_lines, post_lines, imported = importBlock(pre_lines, *import_block, *import_block_end)
+		if imported {
+			log.Printf("Importing %d lines from block %s in %s", len(pin_lines), *import_block, path)
+		}
+	}
+
+	// remove any entries for our hosts outside our block if asked to
+	removed := 0
+	if *remove_duplicates {
+		var pre_removed, post_removed int
+		pre_lines, pre_removed = removeManagedNames(pre_lines, hosts, path)
+		post_lines, post_removed = removeManagedNames(post_lines, hosts, path)
+		removed = pre_removed + post_removed
+	}
+
+	// warn about, or comment out, any entries outside our block which map our hosts elsewhere
+	pre_lines, pre_commented := checkExternalConflicts(pre_lines, hosts, path)
+	post_lines, post_commented := checkExternalConflicts(post_lines, hosts, path)
+	removed += pre_commented + post_commented
+
+	// parse our current mappings
+	pin_lines = currentEntries(pin_lines)
+	current_mappings := parseMappings(pin_lines)
+
+	// no rewrite needed if our block would be exactly what's already there and it didn't need repairing, return
+	block := renderEntries(hosts, current_mappings)
+	if removed == 0 && len(problems) == 0 && slices.Equal(block, pin_lines) {
+		return false, nil
+	}
+	err = checkShrink(path, pin_lines, block)
+	if err != nil {
+		return false, err
+	}
+	logDelta(path, pin_lines, block)
+
+	block = blockLines(block)
+
+	// ok, rewrite our hosts file, lines before our block, our block, then lines after it
+	lines := make([]string, 0, len(pre_lines)+len(block)+len(post_lines)+2)
+	lines = append(lines, pre_lines...)
+	lines = append(lines, DNSPIN_BEGIN)
+	lines = append(lines, block...)
+	lines = append(lines, DNSPIN_END)
+	lines = append(lines, post_lines...)
+
+	// keep the file ending the way it did unless we always want a trailing newline
+	trailing_newline := true
+	if !*force_newline {
+		trailing_newline, err = endsWithNewline(path)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = writeAtomically(path, lines, trailing_newline)
+	if err != nil {
+		return false, err
+	}
+
+	// make sure our block landed as we wrote it if asked to
+	if *verify_writes {
+		_, written, _, _, err := readHostsFile(path, hosts)
+		if err != nil {
+			log.Printf("Error verifying %s: %v", path, err)
+		} else if !slices.Equal(written, block) {
+			log.Printf("Error verifying %s: block differs from what we wrote, another process may have replaced it", path)
+		}
+	}
+
+	// keep a copy of the whole file as we left it if asked to
+	if *archive_dir != "" {
+		if err := archiveFile(path, *archive_dir, *archive_keep); err != nil {
+			log.Printf("Error archiving %s to %s: %v", path, *archive_dir, err)
+		}
+	}
+
+	// record what changed if we keep a changelog
+	// the hosts file has been replaced regardless, so failing to record it isn't a write error
+	if *changelog_path != "" {
+		if err := appendChangelog(*changelog_path, hosts, current_mappings); err != nil {
+			log.Printf("Error writing changelog %s: %v", *changelog_path, err)
+		}
+	}
+
+	return true, nil
+}
+
+// the start of the footer comment we end our block with if asked to
+const FOOTER_PREFIX = "# generated by dnspin "
+
+// returns the entries in the passed in lines from our block, leaving out our footer as it changes every time we write
+func currentEntries(pin_lines []string) []string {
+	if !*block_footer {
+		return pin_lines
+	}
+	return slices.DeleteFunc(slices.Clone(pin_lines), isFooter)
+}
+
+// returns the lines we write in our block for the passed in entries, ending with our footer if asked to
+func blockLines(entries []string) []string {
+	if !*block_footer {
+		return entries
+	}
+	return append(slices.Clone(entries), footerLine(entries))
+}
+
+// returns the footer for the passed in block, describing when and by which version it was generated
+func footerLine(block []string) string {
+	entries := 0
+	for _, line := range block {
+		if !strings.HasPrefix(line, "#") {
+			entries += 1
+		}
+	}
+	return fmt.Sprintf("%s%s at %s (%d entries)", FOOTER_PREFIX, version, time.Now().UTC().Format(time.RFC3339), entries)
+}
+
+// returns whether the passed in line is our footer
+func isFooter(line string) bool {
+	return strings.HasPrefix(line, FOOTER_PREFIX)
+}
+
+// removes our block from the passed in hosts file, leaving the lines before and after it untouched
+func removeHostsBlock(path string, hosts []*host_config) (removed bool, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !slices.Contains(strings.Split(string(contents), "\n"), DNSPIN_BEGIN) {
+		return false, nil
+	}
+
+	pre_lines, pin_lines, post_lines, _, err := readHostsFile(path, hosts)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Pinning disabled, removing block of %d lines from %s", len(pin_lines), path)
+
+	trailing_newline := true
+	if !*force_newline {
+		trailing_newline = strings.HasSuffix(string(contents), "\n")
+	}
+	return true, writeAtomically(path, append(pre_lines, post_lines...), trailing_newline)
+}
+
+// writes our entries to a dnsmasq addn-hosts file, which is entirely managed by us
+func writeDnsmasqFile(path string, hosts []*host_config) (wrote bool, err error) {
+	defer func() { err = classifyError(err) }()
+	hosts = pinnedHosts(hosts)
+
+	// read in our current entries, it's fine if we haven't written the file yet
+	current_lines := make([]string, 0, 10)
+	in, err := os.Open(path)
+	if err == nil {
+		defer in.Close()
+
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			current_lines = append(current_lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	// our comments may not start with #, which we need to know to parse our entries
+	current_entries := commentsWith(current_lines, *comment_char, "#")
+	current_mappings := parseMappings(current_entries)
+
+	entries := []string{"# managed by dnspin, do not edit"}
+	entries = append(entries, renderEntries(hosts, current_mappings)...)
+	lines := commentsWith(entries, "#", *comment_char)
+	if slices.Equal(lines, current_lines) {
+		return false, nil
+	}
+	err = checkShrink(path, current_entries, entries)
+	if err != nil {
+		return false, err
+	}
+	logDelta(path, current_lines, lines)
+
+	err = writeAtomically(path, lines, true)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// a file we write our pinned entries to
+type output_target struct {
+	path  string
+	write func(path string, hosts []*host_config) (bool, error)
+}
+
+// returns the output targets we've been configured to write to
+func outputTargets() []output_target {
+	targets := make([]output_target, 0, 3)
+	if *hosts_file != "" {
+		targets = append(targets, output_target{*hosts_file, writeHostsFile})
+	}
+	if *dnsmasq_file != "" {
+		targets = append(targets, output_target{*dnsmasq_file, writeDnsmasqFile})
+	}
+	if *env_file != "" {
+		targets = append(targets, output_target{*env_file, writeEnvFile})
+	}
+	return targets
+}
+
+// returns how many addresses we pin for this host
+func (h *host_config) maxIPs() int {
+	if h.max_ips > 0 {
+		return h.max_ips
+	}
+	return *max_ips
+}
+
+// returns the networks we prefer to pin addresses in for this host, in order
+func (h *host_config) preferCIDRs() []*net.IPNet {
+	if len(h.prefer_cidrs) > 0 {
+		return h.prefer_cidrs
+	}
+	return prefer_cidrs
+}
+
+// returns how long we wait for an answer to each query for this host
+func (h *host_config) dnsTimeout() time.Duration {
+	if h.timeout > 0 {
+		return h.timeout
+	}
+	return *dns_timeout
+}
+
+// returns how long we hold this host's addresses after they change
+func (h *host_config) changeCooldown() time.Duration {
+	if h.cooldown > 0 {
+		return h.cooldown
+	}
+	return *change_cooldown
+}
+
+// returns the record types we query for this host in order of preference, falling back to the next if
+// there are no records of a type, or those we query for the union of if configured with types
+func (h *host_config) queryTypes() []uint16 {
+	if len(h.query_types) > 0 {
+		return h.query_types
+	}
+	switch h.prefer {
+	case "v4":
+		return []uint16{dns.TypeA, dns.TypeAAAA}
+	case "v6":
+		return []uint16{dns.TypeAAAA, dns.TypeA}
+	default:
+		return []uint16{dns.TypeA}
+	}
+}
+
+// returns the name we query for this host, which is the name we pin unless configured otherwise
+func (h *host_config) queryName() string {
+	if h.query_name != "" {
+		return h.query_name
+	}
+	return h.hostname
+}
+
+// returns the names we write in entries for this host, which includes its short name and CNAME targets if asked to
+func (h *host_config) names() []string {
+	names := []string{h.hostname}
+	if *short_names {
+		if short, _, found := strings.Cut(h.hostname, "."); found && short != "" {
+			names = append(names, short)
+		}
+	}
+
+	// the names our hostname is a CNAME of, if we pin those too
+	if h.cname_aliases {
+		for _, alias := range h.aliases {
+			if !slices.Contains(names, alias) {
+				names = append(names, alias)
+			}
+		}
+	}
+	return names
+}
+
+// returns the class we query for this host
+func (h *host_config) queryClass() uint16 {
+	if h.query_class != 0 {
+		return h.query_class
+	}
+	return query_class
+}
+
+// returns whether this host currently has a valid address
+func (h *host_config) resolved() bool {
+	return h.ip_address != NIL && h.ip_address != ERROR && h.ip_address != MISSING
+}
+
+// returns whether the passed in hostname is one of our hosts
+func hasHost(hosts []*host_config, hostname string) bool {
+	for _, host := range hosts {
+		if host.hostname == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// marks this host as having failed its lookup
+func (h *host_config) setError() {
+	h.ip_address = ERROR
+	h.ip_addresses = nil
+	h.next_query = time.Time{}
+	log.Printf("%s = %s%s", h.hostname, h.ip_address, h.tagSuffix())
+}
+
+// returns this host's tags formatted for the end of a log line, sorted by name
+func (h *host_config) tagSuffix() string {
+	if len(h.tags) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(h.tags))
+	for name, value := range h.tags {
+		tags = append(tags, name+"="+value)
+	}
+	sort.Strings(tags)
+	return " [" + strings.Join(tags, " ") + "]"
+}
+
+// returns whether this host is looked up using the os resolver, without loading our system resolvers
+func (h *host_config) osResolved() bool {
+	return (h.dns_server == SYSTEM && *os_resolver) || slices.Contains(strings.Split(h.dns_server, ","), OS)
+}
+
+// returns the DNS servers to try for this host, in order
+func (h *host_config) servers() []string {
+	if h.dns_server == SYSTEM && *os_resolver {
+		return []string{OS}
+	}
+	if h.dns_server == SYSTEM {
+		return systemResolvers()
+	}
+	return strings.Split(h.dns_server, ",")
+}
+
+// looks up the passed in host against each of its servers until one answers, returning the result and the server used
+func lookupHost(ctx context.Context, host *host_config) (*lookup_result, string, error) {
+	servers := host.servers()
+	if len(servers) == 0 {
+		return nil, "", withKind(errors.New(fmt.Sprintf("no DNS servers available to look up %s", host.hostname)), ERR_NO_SERVERS)
+	}
+
+	if host.fastest && len(servers) > 1 {
+		return lookupFastest(ctx, host, servers)
+	}
+
+	var err error
+	for _, server := range servers {
+		var result *lookup_result
+		result, err = lookupIP(ctx, host, server)
+
+		// a server telling us the name doesn't exist has answered, so we don't ask the next
+		if err == nil || errors.Is(err, ERR_NO_RECORD) {
+			return result, server, err
+		}
+		if len(servers) > 1 {
+			log.Printf("Error looking up %s via %s, trying next server: %s", host.hostname, server, err)
+		}
+	}
+	return nil, "", err
+}
+
+// looks up the passed in host against all of the passed in servers at once, returning the answer of whichever
+// answered fastest
+func lookupFastest(ctx context.Context, host *host_config, servers []string) (*lookup_result, string, error) {
+	type server_result struct {
+		server string
+		result *lookup_result
+		err    error
+	}
+
+	results := make(chan server_result, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			result, err := lookupIP(ctx, host, server)
+			results <- server_result{server, result, err}
+		}(server)
+	}
+
+	var fastest *server_result
+	var err error
+	answers := make(map[string]string, len(servers))
+	for range servers {
+		answer := <-results
+		if answer.err != nil && !errors.Is(answer.err, ERR_NO_RECORD) {
+			log.Printf("Error looking up %s via %s: %s", host.hostname, answer.server, answer.err)
+			err = answer.err
+			continue
+		}
+
+		answers[answer.server] = changelogIPs(answer.result.ip_addresses)
+		if fastest == nil || answer.result.rtt < fastest.result.rtt {
+			fastest = &answer
+		} else if answer.result.rtt == fastest.result.rtt {
+			log.Printf("%s answered as fast as %s for %s, using %s", answer.server, fastest.server, host.hostname, fastest.server)
+		}
+	}
+	if fastest == nil {
+		return nil, "", err
+	}
+
+	// servers disagreeing may mean some of them have stale answers
+	for server, ip_addresses := range answers {
+		if ip_addresses != answers[fastest.server] {
+			log.Printf("Warning: %s is %s via %s but %s via fastest server %s", host.hostname, ip_addresses, server, answers[fastest.server], fastest.server)
+		}
+	}
+
+	return fastest.result, fastest.server, fastest.err
+}
+
+// checks whether we can open a TCP connection to the passed in IP and port
+func checkReachable(ip_address string, port string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip_address, port), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// the networks of our interface addresses, refreshed each cycle when we only pin local addresses
+var local_subnets []*net.IPNet
+
+// returns the networks of each of our interface addresses
+func localSubnets() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	subnets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if subnet, is_net := addr.(*net.IPNet); is_net {
+			subnets = append(subnets, &net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask})
+		}
+	}
+	return subnets, nil
+}
+
+// rereads our local networks if we only pin local addresses, keeping the ones we have if we can't
+func refreshLocalSubnets() {
+	if !*local_subnets_only {
+		return
+	}
+	subnets, err := localSubnets()
+	if err != nil {
+		log.Printf("Error reading interface addresses, keeping previous local networks: %v", err)
+		return
+	}
+	local_subnets = subnets
+}
+
+// returns whether the two passed in lists of addresses have the same addresses, in any order
+func sameIPs(a []string, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	sort.Strings(a)
+	sort.Strings(b)
+	return slices.Equal(a, b)
+}
+
+// returns whether the passed in IP is in any of the passed in networks
+func inSubnets(ip net.IP, subnets []*net.IPNet) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// looks up the passed in host, updating it with the result
+func resolveHost(ctx context.Context, host *host_config, now time.Time) {
+	if host.axfr {
+		resolveZone(host, now)
+		return
+	}
+
+	host.conflicted = false
+	host.rotation += 1
+	// a name which doesn't exist is missing, just like one without any addresses
+	result, server, err := lookupHost(ctx, host)
+	if err != nil && !errors.Is(err, ERR_NO_RECORD) {
+		log.Printf("Error: %s", err)
+		host.setError()
+		return
+	}
+
+	// only trust our answer if an independent server agrees with it
+	if host.verify_server != "" {
+		verified, err := lookupIP(ctx, host, host.verify_server)
+		if err != nil && !errors.Is(err, ERR_NO_RECORD) {
+			log.Printf("Error: unable to verify %s via %s: %s", host.hostname, host.verify_server, err)
+			host.setError()
+			return
+		}
+		// we compare everything each server returned, as which of those we pin may differ between lookups
+		if !sameIPs(result.answer_ips, verified.answer_ips) {
+			log.Printf("WARNING: %s is %s via %s but %s via %s, keeping previous value", host.hostname,
+				changelogIPs(result.answer_ips), server, changelogIPs(verified.answer_ips), host.verify_server)
+			host.setError()
+			host.conflicted = true
+			return
+		}
+	}
+
+	// too few addresses for a host which should have several may mean part of its pool has gone
+	if host.min_answers > 0 && result.ip_address != MISSING && result.answers < host.min_answers {
+		log.Printf("Error: %s has %d addresses via %s, expected at least %d", host.hostname, result.answers, server, host.min_answers)
+		host.setError()
+		return
+	}
+
+	// hosts which should only ever have one address are an error if they have more
+	if (host.single_ip || *strict_single_ip) && result.answers > 1 {
+		log.Printf("Error: %s has %d addresses via %s, expected only one", host.hostname, result.answers, server)
+		host.setError()
+		return
+	}
+
+	// make sure the IPs map back to our host if asked to
+	if (*check_ptr || *strict_ptr) && result.ip_address != MISSING {
+		for _, ip_address := range result.ip_addresses {
+			confirmed, err := checkPTR(ctx, host.queryName(), ip_address, server)
+			if err != nil {
+				log.Printf("Warning: PTR lookup of %s for %s failed: %s", ip_address, host.hostname, err)
+			} else if !confirmed {
+				log.Printf("Warning: PTR of %s does not map back to %s", ip_address, host.queryName())
+			}
+
+			if !confirmed && *strict_ptr {
+				host.setError()
+				return
+			}
+		}
+	}
+
+	// only pin addresses which are reachable if we have a health check
+	if host.healthcheck_port != "" && result.ip_address != MISSING {
+		healthy := make([]string, 0, len(result.ip_addresses))
+		for _, ip_address := range result.ip_addresses {
+			err := checkReachable(ip_address, host.healthcheck_port, host.healthcheck_timeout)
+			if err != nil {
+				log.Printf("Warning: %s for %s failed health check, not pinning: %v", ip_address, host.hostname, err)
+			} else {
+				healthy = append(healthy, ip_address)
+			}
+		}
+
+		// none are healthy, keep whatever we had before
+		if len(healthy) == 0 {
+			host.setError()
+			return
+		}
+		result.ip_addresses = healthy
+		result.ip_address = healthy[0]
+	}
+
+	// only pin addresses on one of our local networks if asked to
+	if *local_subnets_only && result.ip_address != MISSING {
+		local := make([]string, 0, len(result.ip_addresses))
+		for _, ip_address := range result.ip_addresses {
+			if inSubnets(net.ParseIP(ip_address), local_subnets) {
+				local = append(local, ip_address)
+			} else {
+				log.Printf("Warning: %s for %s is not on any local network, not pinning", ip_address, host.hostname)
+			}
+		}
+
+		// none are local, keep whatever we had before
+		if len(local) == 0 {
+			host.setError()
+			return
+		}
+		result.ip_addresses = local
+		result.ip_address = local[0]
+	}
+
+	// hold our addresses for a while after they change, so answers flapping between values don't keep changing them
+	if host.resolved() && !slices.Equal(host.ip_addresses, result.ip_addresses) {
+		cooldown := host.changeCooldown()
+		if cooldown > 0 && now.Sub(host.changed_on) < cooldown {
+			log.Printf("%s = %s (changed less than %v ago, ignoring %s via %s)%s", host.hostname, strings.Join(host.ip_addresses, ","), cooldown, strings.Join(result.ip_addresses, ","), server, host.tagSuffix())
+			return
+		}
+		host.changed_on = now
+	}
+
+	// caching resolvers count the TTL down on every answer, so we only show the one we saw when our addresses
+	// last changed, otherwise our block would change every cycle
+	if !slices.Equal(host.ip_addresses, result.ip_addresses) {
+		host.shown_ttl = result.ttl
+	}
+
+	host.ip_address = result.ip_address
+	host.ip_addresses = result.ip_addresses
+	host.aliases = result.aliases
+	host.rtt = result.rtt
+	host.answered_by = server
+	host.ttl = result.ttl
+	host.next_query = now.Add(time.Duration(result.ttl) * time.Second)
+	if result.ip_address != MISSING {
+		host.last_success = now
+	}
+	if result.ip_address == MISSING {
+		log.Printf("%s = %s (%v via %s)%s", host.hostname, host.ip_address, result.rtt, server, host.tagSuffix())
+	} else {
+		log.Printf("%s = %s (%v via %s)%s", host.hostname, strings.Join(host.ip_addresses, ","), result.rtt, server, host.tagSuffix())
+	}
+}
+
+// resolves our hosts until at least one of them resolves to an address or we time out, returning whether any did
+func warmUp(hosts []*host_config, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		now := time.Now()
+		refreshLocalSubnets()
+		for _, host := range hosts {
+			if host.enabled {
+				resolveHost(context.Background(), host, now)
+				if host.resolved() {
+					return true
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// the host our next cycle starts looking up from when limited by --max-lookups-per-cycle, we keep its name
+// rather than its position so it survives our config being reloaded
+var next_lookup string
+
+// resolves all our enabled hosts that are due a lookup, returning how many we looked up and how many of
+// those got an answer
+func resolveHosts(hosts []*host_config) (looked_up int, answered int) {
+	now := time.Now()
+
+	// bound how long our lookups can take, including any time spent waiting on rate limits
+	ctx := context.Background()
+	if *cycle_timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *cycle_timeout)
+		defer cancel()
+	}
+
+	// our machine may have moved networks since our last cycle
+	refreshLocalSubnets()
+
+	// if we're limited in how many hosts we look up each cycle, start from where our last cycle left off
+	start := 0
+	if *max_lookups > 0 {
+		start = max(slices.IndexFunc(hosts, func(h *host_config) bool { return h.hostname == next_lookup }), 0)
+	}
+
+	for i := range (hosts) {
+		host := hosts[(start + i) % len(hosts)]
+		if !host.enabled {
+			log.Printf("%s = disabled", host.hostname)
+			continue
+		}
+
+		// our last answer for this host is still within its TTL, keep it
+		if *respect_ttl && now.Before(host.next_query) {
+			continue
+		}
+
+		if *max_lookups > 0 && looked_up >= *max_lookups {
+			next_lookup = host.hostname
+			log.Printf("Looked up %d hosts, leaving the rest for our next cycle", looked_up)
+			return looked_up, answered
+		}
+
+		resolveHost(ctx, host, now)
+		looked_up += 1
+		if host.ip_address != ERROR {
+			answered += 1
+		}
+	}
+	return looked_up, answered
+}
+
+// returns how many of our enabled hosts failed to resolve, and how many enabled hosts we've looked up
+func countFailures(hosts []*host_config) (failed int, total int) {
+	for _, host := range pinnedHosts(hosts) {
+		// hosts we haven't looked up yet keep their old entries, so don't count either way
+		if host.ip_address == NIL {
+			continue
+		}
+		total += 1
+		if host.ip_address == ERROR || host.ip_address == MISSING {
+			failed += 1
+		}
+	}
+	return failed, total
+}
+
+// how long we're waiting before retrying a target we weren't allowed to write
+type write_backoff struct {
+	delay    time.Duration
+	retry_on time.Time
+}
+
+var write_backoffs = make(map[string]*write_backoff)
+
+// whether writes have been paused by SIGUSR2, we keep looking up our hosts but leave our targets untouched
+var paused bool
+
+// when we last rewrote each target, so we can hold off rewriting it again within our minimum write interval
+var last_rewrites = make(map[string]time.Time)
+
+// rewrites our hosts file and any other targets with the current state of our hosts
+func writeTargets(hosts []*host_config, first_cycle bool) {
+	if paused {
+		log.Printf("Writes paused, not writing any changes")
+		return
+	}
+
+	// an empty config is much more likely a mistake than a request to clear all of our entries
+	if len(hosts) == 0 {
+		log.Printf("Warning: no hosts configured, leaving existing entries untouched")
+		return
+	}
+
+	// if too many hosts failed, assume our resolvers are broken rather than the hosts changing
+	failed, total := countFailures(hosts)
+	if total > 0 && float64(failed)/float64(total) > *max_failure_ratio {
+		log.Printf("WARNING: %d of %d hosts failed to resolve, exceeding max failure ratio of %.2f, not writing any changes", failed, total, *max_failure_ratio)
+		return
+	}
+
+	// a confirmation to remove more entries than our limits only applies to a single cycle
+	defer func() { shrink_confirmed = false }()
+
+	for _, target := range outputTargets() {
+		// we're backing off after being denied permission to write this target
+		backoff := write_backoffs[target.path]
+		if backoff != nil && time.Now().Before(backoff.retry_on) {
+			continue
+		}
+
+		// we rewrote this target too recently, any changes will be written once our interval is up
+		last_rewrite, rewritten := last_rewrites[target.path]
+		if rewritten && time.Since(last_rewrite) < *min_write_interval {
+			continue
+		}
+
+		wrote, err := target.write(target.path, hosts)
+		recordWrite(target.path, err)
+		if errors.Is(err, ERR_WRITE_DENIED) {
+			log.Printf("Error writing %s: %v", target.path, err)
+			log.Printf("Cannot replace %s, run as root or make it, its directory and the temp dir writable by this user", target.path)
+
+			// retry less and less often, so we don't fill the log every cycle
+			if *permission_backoff > 0 {
+				if backoff == nil {
+					backoff = &write_backoff{delay: CYCLE_INTERVAL}
+					write_backoffs[target.path] = backoff
+				}
+				backoff.delay = min(backoff.delay*2, *permission_backoff)
+				backoff.retry_on = time.Now().Add(backoff.delay)
+				log.Printf("Retrying %s in %v", target.path, backoff.delay)
+			}
+		} else if err != nil {
+			log.Printf("Error writing %s: %v", target.path, err)
+		} else {
+			delete(write_backoffs, target.path)
+
+			if wrote {
+				log.Printf("%s updated", target.path)
+				if *min_write_interval > 0 {
+					last_rewrites[target.path] = time.Now()
+					log.Printf("Holding any further changes to %s for %v", target.path, *min_write_interval)
+				}
+			} else if first_cycle {
+				log.Printf("%s already in sync at startup, not updated", target.path)
+			} else {
+				log.Printf("No changes, %s not updated", target.path)
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	// log to a file instead of stderr if asked to
+	var logs *reopenable_log
+	if *log_path != "" {
+		var err error
+		logs, err = openLogFile(*log_path)
+		if err != nil {
+			log.Fatalf("Error opening log file %s: %v", *log_path, err)
+		}
+		log.SetOutput(logs)
+	}
+
+	// systemd adds its own timestamps, and log ingestion is easier with RFC3339 ones
+	switch *log_timestamps {
+	case "default":
+	case "rfc3339":
+		log.SetFlags(0)
+		log.SetOutput(&timestamped_log{out: log.Writer()})
+	case "none":
+		log.SetFlags(0)
+	default:
+		log.Fatalf("Invalid --log-timestamps %s, must be default, rfc3339 or none", *log_timestamps)
+	}
+
+	if *dns_timeout <= 0 {
+		log.Fatalf("Invalid --dns-timeout %v, must be positive", *dns_timeout)
+	}
+
+	if *max_ips < 1 {
+		log.Fatalf("Invalid --max-ips %d, must be at least 1", *max_ips)
+	}
+
+	if !slices.Contains([]string{"", "udp", "tcp", "udp4", "udp6", "tcp4", "tcp6", "tcp-tls", "quic"}, *dns_net) {
+		log.Fatalf("Invalid --dns-net %s, must be udp, tcp, udp4, udp6, tcp4, tcp6, tcp-tls or quic", *dns_net)
+	}
+
+	// any host can use a TLS based transport, so we always load our TLS config
+	var err error
+	tls_config, err = loadTLSConfig()
+	if err != nil {
+		log.Fatalf("Error loading TLS config: %v", err)
+	}
+
+	if *udp_size < 0 || (*udp_size > 0 && *udp_size < dns.MinMsgSize) || *udp_size > dns.MaxMsgSize {
+		log.Fatalf("Invalid --udp-size %d, must be between %d and %d", *udp_size, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+
+	if *empty_config != "warn" && *empty_config != "exit" {
+		log.Fatalf("Invalid --empty-config %s, must be warn or exit", *empty_config)
+	}
+
+	if *comment_char == "" || strings.ContainsAny(*comment_char, " \t") {
+		log.Fatalf("Invalid --comment-char %q", *comment_char)
+	}
+
+	if *external_conflicts != "warn" && *external_conflicts != "comment" {
+		log.Fatalf("Invalid --external-conflicts %s, must be warn or comment", *external_conflicts)
+	}
+
+	if *outage_backoff_factor < 1 {
+		log.Fatalf("Invalid --outage-backoff-factor %v, must be at least 1", *outage_backoff_factor)
+	}
+
+	if *group_by != "" && *group_by != "server" && (!strings.HasPrefix(*group_by, "tag.") || *group_by == "tag.") {
+		log.Fatalf("Invalid --group-by %s, must be server or tag.NAME", *group_by)
+	}
+
+	if *separator != "tab" && *separator != "space" && *separator != "aligned" {
+		log.Fatalf("Invalid --separator %s, must be tab, space or aligned", *separator)
+	}
+
+	if *prefer_cidrs_spec != "" {
+		prefer_cidrs, err = parseCIDRs(*prefer_cidrs_spec)
+		if err != nil {
+			log.Fatalf("Invalid --prefer-cidrs: %v", err)
+		}
+	}
+
+	qps_overrides, err = parseQPSOverrides(*server_qps_overrides)
+	if err != nil {
+		log.Fatalf("Invalid --server-qps-overrides: %v", err)
+	}
+
+	var exists bool
+	query_class, exists = dns.StringToClass[strings.ToUpper(*query_class_name)]
+	if !exists {
+		log.Fatalf("Invalid --query-class %s", *query_class_name)
+	}
+
+	if *metrics_addr != "" {
+		serveMetrics(*metrics_addr)
+	}
+
+	// run any subcommand we've been given instead of our loop
+	switch flag.Arg(0) {
+	case "":
+	case "check-hosts":
+		os.Exit(checkHostsFile(*hosts_file))
+	case "print-config":
+		os.Exit(printConfig(*config_source, flag.Arg(1)))
+	case "export":
+		os.Exit(exportBlock(*config_source))
+	case "selftest":
+		os.Exit(selfTest(flag.Arg(1), flag.Arg(2)))
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	// we no longer need root, drop to our configured user if we have one
+	if *run_as != "" {
+		err := dropPrivileges(*run_as)
+		if err != nil {
+			log.Fatalf("Error dropping privileges to %s: %v", *run_as, err)
+		}
+		for _, target := range outputTargets() {
+			err := checkWriteAccess(target.path)
+			if err != nil {
+				log.Fatalf("Unable to write %s as %s: %v", target.path, *run_as, err)
+			}
+		}
+		log.Printf("Running as %s", *run_as)
+	}
+
+	hosts, err := loadHostConfig(*config_source)
+	if err != nil {
+		log.Fatalf("Error loading %s: %v", *config_source, err)
+	}
+	loaded_on := time.Now()
+	updateTagMetrics(hosts)
+
+	if len(hosts) == 0 {
+		if *empty_config == "exit" {
+			log.Fatalf("No hosts configured in %s, exiting", *config_source)
+		}
+		log.Printf("Warning: no hosts configured in %s, existing entries will be left untouched", *config_source)
+	}
+
+	if err := checkServer(*names_server); err != nil {
+		log.Fatalf("Invalid --names-server: %v", err)
+	}
+
+	if *canary != "" && !hasHost(hosts, *canary) {
+		log.Fatalf("Canary %s is not one of the hosts in %s", *canary, *config_source)
+	}
+
+	// the network may not be up yet on boot, wait for a host to resolve before we write anything
+	if *warmup > 0 && !warmUp(hosts, *warmup) {
+		if *warmup_exit {
+			log.Fatalf("No hosts resolved within warm-up period of %v, exiting", *warmup)
+		}
+		log.Printf("Warning: no hosts resolved within warm-up period of %v, proceeding", *warmup)
+	}
+
+	// reload our config and reopen our log file on SIGHUP, exit cleanly on SIGTERM or SIGINT
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, syscall.SIGINT)
+
+	// dump our state for diagnostics on SIGUSR1
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+
+	// pause and resume writing our targets on SIGUSR2
+	pause := make(chan os.Signal, 1)
+	signal.Notify(pause, syscall.SIGUSR2)
+	shrink_confirmed = *force
+
+	// accept commands on our admin socket if we have one
+	var admin chan *admin_request
+	if *admin_socket != "" {
+		admin = make(chan *admin_request)
+		err := serveAdmin(*admin_socket, admin)
+		if err != nil {
+			log.Fatalf("Error listening on admin socket %s: %v", *admin_socket, err)
+		}
+		defer os.Remove(*admin_socket)
+	}
+
+	// reload our config whenever it changes if asked to
+	var config_changed <-chan struct{}
+	if *watch_config {
+		if strings.HasPrefix(*config_source, "http://") || strings.HasPrefix(*config_source, "https://") {
+			log.Fatalf("Unable to watch %s, --watch-config only works with config files", *config_source)
+		}
+		config_changed, err = watchConfig(*config_source)
+		if err != nil {
+			log.Fatalf("Error watching %s: %v", *config_source, err)
+		}
+	}
+
+	run(hosts, loaded_on, logs, loop_signals{reload, shutdown, dump, pause, admin, config_changed})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// writes the passed in lines to a hosts file in a temp dir, returning its path
+func writeTestHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadHostsFile(t *testing.T) {
+	hosts := []*host_config{
+		{hostname: "redis.example.com", dns_server: SYSTEM, ip_address: NIL, enabled: true},
+		{hostname: "db.example.com", dns_server: SYSTEM, ip_address: NIL, enabled: true},
+	}
+
+	tests := []struct {
+		name     string
+		lines    []string
+		pre      []string
+		pin      []string
+		post     []string
+		repaired bool
+	}{
+		{
+			name:  "well formed",
+			lines: []string{"127.0.0.1 localhost", DNSPIN_BEGIN, "10.0.0.1\tredis.example.com", DNSPIN_END, "10.0.0.9 mybox"},
+			pre:   []string{"127.0.0.1 localhost"},
+			pin:   []string{"10.0.0.1\tredis.example.com"},
+			post:  []string{"10.0.0.9 mybox"},
+		},
+		{
+			name:  "no block",
+			lines: []string{"127.0.0.1 localhost"},
+			pre:   []string{"127.0.0.1 localhost"},
+		},
+		{
+			name: "two blocks",
+			lines: []string{
+				"127.0.0.1 localhost",
+				DNSPIN_BEGIN, "10.0.0.1\tredis.example.com", DNSPIN_END,
+				"10.0.0.9 mybox",
+				DNSPIN_BEGIN, "10.0.0.2\tredis.example.com", DNSPIN_END,
+				"10.0.0.8 otherbox",
+			},
+			pre:      []string{"127.0.0.1 localhost"},
+			pin:      []string{"10.0.0.1\tredis.example.com"},
+			post:     []string{"10.0.0.9 mybox", "10.0.0.8 otherbox"},
+			repaired: true,
+		},
+		{
+			name:     "BEGIN inside block",
+			lines:    []string{DNSPIN_BEGIN, "10.0.0.1\tredis.example.com", DNSPIN_BEGIN, "10.0.0.2\tredis.example.com", DNSPIN_END, "10.0.0.9 mybox"},
+			pin:      []string{"10.0.0.1\tredis.example.com"},
+			post:     []string{"10.0.0.9 mybox"},
+			repaired: true,
+		},
+		{
+			name:     "END before BEGIN",
+			lines:    []string{"127.0.0.1 localhost", DNSPIN_END, DNSPIN_BEGIN, "10.0.0.1\tredis.example.com", DNSPIN_END},
+			pre:      []string{"127.0.0.1 localhost"},
+			pin:      []string{"10.0.0.1\tredis.example.com"},
+			repaired: true,
+		},
+		{
+			name:     "missing END",
+			lines:    []string{"127.0.0.1 localhost", DNSPIN_BEGIN, "# db.example.com: cached value", "10.0.0.2\tdb.example.com", "10.0.0.1\tredis.example.com", "10.0.0.9 mybox", "10.0.0.3\tdb.example.com"},
+			pre:      []string{"127.0.0.1 localhost"},
+			pin:      []string{"# db.example.com: cached value", "10.0.0.2\tdb.example.com", "10.0.0.1\tredis.example.com"},
+			post:     []string{"10.0.0.9 mybox", "10.0.0.3\tdb.example.com"},
+			repaired: true,
+		},
+		{
+			name:     "missing END with nothing of ours",
+			lines:    []string{DNSPIN_BEGIN, "10.0.0.9 mybox"},
+			post:     []string{"10.0.0.9 mybox"},
+			repaired: true,
+		},
+		{
+			name:     "missing END in an extra block",
+			lines:    []string{DNSPIN_BEGIN, "10.0.0.1\tredis.example.com", DNSPIN_END, DNSPIN_BEGIN, "10.0.0.2\tredis.example.com", "10.0.0.9 mybox"},
+			pin:      []string{"10.0.0.1\tredis.example.com"},
+			post:     []string{"10.0.0.9 mybox"},
+			repaired: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pre, pin, post, problems, err := readHostsFile(writeTestHosts(t, test.lines...), hosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(pre, test.pre) || !slices.Equal(pin, test.pin) || !slices.Equal(post, test.post) {
+				t.Errorf("got pre=%q pin=%q post=%q, expected pre=%q pin=%q post=%q", pre, pin, post, test.pre, test.pin, test.post)
+			}
+			if repaired := len(problems) > 0; repaired != test.repaired {
+				t.Errorf("got problems %q, expected repaired=%v", problems, test.repaired)
+			}
+		})
+	}
+}
+
+func TestWriteHostsFileRepairsMissingEnd(t *testing.T) {
+	hosts := []*host_config{
+		{hostname: "redis.example.com", dns_server: SYSTEM, ip_address: "10.0.0.2", ip_addresses: []string{"10.0.0.2"}, enabled: true},
+	}
+	path := writeTestHosts(t, "127.0.0.1 localhost", DNSPIN_BEGIN, "10.0.0.1\tredis.example.com", "10.0.0.9 mybox")
+
+	wrote, err := writeHostsFile(path, hosts)
+	if err != nil || !wrote {
+		t.Fatalf("got wrote=%v err=%v, expected a write", wrote, err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{"127.0.0.1 localhost", DNSPIN_BEGIN, "10.0.0.2\tredis.example.com", DNSPIN_END, "10.0.0.9 mybox", ""}, "\n")
+	if string(contents) != expected {
+		t.Errorf("got %q, expected %q", contents, expected)
+	}
+
+	// once repaired, writing the same again doesn't change anything
+	wrote, err = writeHostsFile(path, hosts)
+	if err != nil || wrote {
+		t.Errorf("got wrote=%v err=%v, expected no write", wrote, err)
+	}
+}
+
+func TestWriteAtomicallyTempDir(t *testing.T) {
+	path := writeTestHosts(t, "127.0.0.1 localhost")
+	temp_dir_path := t.TempDir()
+
+	// record where our temp files are created, by default next to the target
+	renamed_from := ""
+	original := rename
+	rename = func(from string, to string) error {
+		renamed_from = from
+		return original(from, to)
+	}
+	t.Cleanup(func() { rename = original })
+
+	if err := writeAtomically(path, []string{"10.0.0.1 a"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(renamed_from) != filepath.Dir(path) {
+		t.Errorf("temp file created in %s, expected %s", filepath.Dir(renamed_from), filepath.Dir(path))
+	}
+
+	// our temp dir is tried first when we have one
+	setFlag(t, temp_dir, temp_dir_path)
+	if err := writeAtomically(path, []string{"10.0.0.1 b"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(renamed_from) != temp_dir_path {
+		t.Errorf("temp file created in %s, expected %s", filepath.Dir(renamed_from), temp_dir_path)
+	}
+
+	// and we fall back to the target's dir if we can't create one there
+	setFlag(t, temp_dir, filepath.Join(temp_dir_path, "missing"))
+	if err := writeAtomically(path, []string{"10.0.0.1 c"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(renamed_from) != filepath.Dir(path) {
+		t.Errorf("temp file created in %s, expected fallback to %s", filepath.Dir(renamed_from), filepath.Dir(path))
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "10.0.0.1 c\n" {
+		t.Errorf("got %q, expected our last write", contents)
+	}
+}
+
+func TestWriteAtomicallyCrossDevice(t *testing.T) {
+	path := writeTestHosts(t, "127.0.0.1 localhost")
+	setFlag(t, temp_dir, t.TempDir())
+
+	// a temp dir on another filesystem can't be renamed over our target
+	temp_paths := make([]string, 0, 1)
+	original := rename
+	rename = func(from string, to string) error {
+		temp_paths = append(temp_paths, from)
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { rename = original })
+
+	err := writeAtomically(path, []string{"10.0.0.1 a"}, true)
+	if err == nil || !strings.Contains(err.Error(), "temp dir must be on the same filesystem") {
+		t.Fatalf("got %v, expected an error explaining the temp dir must be on the same filesystem", err)
+	}
+
+	// our target is left untouched and our temp file is cleaned up
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "127.0.0.1 localhost\n" {
+		t.Errorf("got %q, expected the original contents", contents)
+	}
+	if len(temp_paths) != 1 {
+		t.Fatalf("got %d renames, expected 1", len(temp_paths))
+	}
+	if _, err := os.Stat(temp_paths[0]); !os.IsNotExist(err) {
+		t.Errorf("temp file %s was left behind", temp_paths[0])
+	}
+}
+
+func TestEndsWithNewline(t *testing.T) {
+	tests := []struct {
+		contents string
+		expected bool
+	}{
+		{"", true},
+		{"127.0.0.1 localhost\n", true},
+		{"127.0.0.1 localhost", false},
+		{"127.0.0.1 localhost\n\n", true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "hosts")
+		if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ends, err := endsWithNewline(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ends != test.expected {
+			t.Errorf("got %v for %q, expected %v", ends, test.contents, test.expected)
+		}
+	}
+}
+
+func TestWriteHostsFileTrailingNewline(t *testing.T) {
+	hosts := []*host_config{
+		{hostname: "redis.example.com", dns_server: SYSTEM, ip_address: "10.0.0.1", ip_addresses: []string{"10.0.0.1"}, enabled: true},
+	}
+	block := DNSPIN_BEGIN + "\n10.0.0.1\tredis.example.com\n" + DNSPIN_END
+
+	tests := []struct {
+		name          string
+		contents      string
+		force_newline bool
+		expected      string
+	}{
+		{name: "with newline", contents: "127.0.0.1 localhost\n", expected: "127.0.0.1 localhost\n" + block + "\n"},
+		{name: "without newline", contents: "127.0.0.1 localhost", expected: "127.0.0.1 localhost\n" + block},
+		{name: "forced", contents: "127.0.0.1 localhost", force_newline: true, expected: "127.0.0.1 localhost\n" + block + "\n"},
+		{name: "empty", contents: "", expected: block + "\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, force_newline, test.force_newline)
+			path := filepath.Join(t.TempDir(), "hosts")
+			if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := writeHostsFile(path, hosts); err != nil {
+				t.Fatal(err)
+			}
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != test.expected {
+				t.Errorf("got %q, expected %q", contents, test.expected)
+			}
+
+			// rewriting the same block leaves the file as it was
+			wrote, err := writeHostsFile(path, hosts)
+			if err != nil || wrote {
+				t.Errorf("got wrote=%v err=%v, expected no write", wrote, err)
+			}
+		})
+	}
+}
+
+func TestWriteAtomicallyTrailingNewline(t *testing.T) {
+	path := writeTestHosts(t, "127.0.0.1 localhost")
+	for _, trailing_newline := range []bool{true, false} {
+		if err := writeAtomically(path, []string{"a", "b"}, trailing_newline); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "a\nb"
+		if trailing_newline {
+			expected += "\n"
+		}
+		if string(contents) != expected {
+			t.Errorf("got %q with trailing_newline=%v, expected %q", contents, trailing_newline, expected)
+		}
+	}
+}
+
+func TestRenderEntriesNotLookedUp(t *testing.T) {
+	hosts := []*host_config{
+		{hostname: "a.example.com", dns_server: SYSTEM, ip_address: "10.0.0.1", ip_addresses: []string{"10.0.0.1"}, enabled: true},
+		{hostname: "b.example.com", dns_server: SYSTEM, ip_address: NIL, enabled: true},
+		{hostname: "c.example.com", dns_server: SYSTEM, ip_address: NIL, enabled: true},
+		{hostname: "zone.example.com", dns_server: SYSTEM, ip_address: NIL, enabled: true, axfr: true},
+	}
+	current_mappings := map[string][]string{"b.example.com": {"10.0.0.2"}, "db.zone.example.com": {"10.0.1.1"}}
+
+	// hosts we haven't looked up yet keep their current entries, and are left out if they don't have any
+	lines := renderEntries(hosts, current_mappings)
+	expected := []string{"10.0.0.1\ta.example.com", "10.0.0.2\tb.example.com", "10.0.1.1\tdb.zone.example.com"}
+	if !slices.Equal(lines, expected) {
+		t.Errorf("got %q, expected %q", lines, expected)
+	}
+
+	if failed, total := countFailures(hosts); failed != 0 || total != 1 {
+		t.Errorf("got %d of %d failed, expected 0 of 1", failed, total)
+	}
+
+	// and aren't logged as removed in our changelog, only the host we did look up is logged
+	path := filepath.Join(t.TempDir(), "changelog")
+	if err := appendChangelog(path, hosts, current_mappings); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(logged) != 1 || !strings.HasSuffix(logged[0], "\ta.example.com\t-\t10.0.0.1") {
+		t.Errorf("got changelog %q, expected only a.example.com being added", contents)
+	}
+}
+
+func TestWriteHostsFileDisabledMissingEnd(t *testing.T) {
+	setFlag(t, disable_pinning, true)
+	hosts := []*host_config{
+		{hostname: "a.example.com", dns_server: SYSTEM, ip_address: "10.0.0.1", ip_addresses: []string{"10.0.0.1"}, enabled: true},
+	}
+	path := writeTestHosts(t, "127.0.0.1 localhost", DNSPIN_BEGIN, "10.0.0.1\ta.example.com", "10.0.0.9 mybox")
+
+	// our entries are removed with our block even though it has no END marker, anything after them is kept
+	if _, err := writeHostsFile(path, hosts); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "127.0.0.1 localhost\n10.0.0.9 mybox\n"
+	if string(contents) != expected {
+		t.Errorf("got %q, expected %q", contents, expected)
+	}
+}
+
+func TestWriteHostsFileKeepsLinesAfterBlock(t *testing.T) {
+	hosts := []*host_config{
+		{hostname: "redis.example.com", dns_server: SYSTEM, ip_address: "10.0.0.2", ip_addresses: []string{"10.0.0.2"}, enabled: true},
+	}
+	after := []string{"", "# added by hand", "10.0.0.9 mybox", "10.0.0.8 otherbox"}
+	path := writeTestHosts(t, append([]string{"127.0.0.1 localhost", DNSPIN_BEGIN, "10.0.0.1\tredis.example.com", DNSPIN_END}, after...)...)
+
+	// everything after our END marker is kept as it was each time we rewrite our block
+	for _, ip_address := range []string{"10.0.0.2", "10.0.0.3"} {
+		hosts[0].ip_address, hosts[0].ip_addresses = ip_address, []string{ip_address}
+		if _, err := writeHostsFile(path, hosts); err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Join(append([]string{"127.0.0.1 localhost", DNSPIN_BEGIN, ip_address + "\tredis.example.com", DNSPIN_END}, after...), "\n") + "\n"
+		if string(contents) != expected {
+			t.Errorf("got %q, expected %q", contents, expected)
+		}
+	}
+}
+
+func TestParseHostConfigSystemResolvers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte("nameserver 10.0.0.53\nnameserver 10.0.0.54\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, resolv_conf, path)
+	setFlag(t, rotate_resolvers, true)
+	reloadSystemResolvers()
+	t.Cleanup(reloadSystemResolvers)
+	rotation := system_rotation
+
+	// parsing our config doesn't load our system resolvers, or rotate them before we've looked anything up
+	hosts, err := parseHostConfig(strings.NewReader("a.example.com\nb.example.com system\n"))
+	if err != nil || len(hosts) != 2 {
+		t.Fatalf("got %d hosts and err=%v, expected 2 hosts", len(hosts), err)
+	}
+	if system_config != nil || system_rotation != rotation {
+		t.Errorf("expected our system resolvers not to be loaded or rotated")
+	}
+
+	// but we still know which hosts use the os resolver when checking their options
+	setFlag(t, os_resolver, true)
+	if _, err := parseHostConfig(strings.NewReader("a.example.com system axfr\n")); err == nil {
+		t.Errorf("expected an error for axfr with the os resolver")
+	}
+	if _, err := parseHostConfig(strings.NewReader("a.example.com 10.0.0.53 axfr\n")); err != nil {
+		t.Errorf("got %v, expected axfr to be allowed with a server", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// returns the env var we write the address of the passed in name to, with everything but letters and digits
+// replaced with underscores
+func envName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	return "DNSPIN_" + strings.ToUpper(sanitized)
+}
+
+// writes the first pinned address of each of our names to an env file as DNSPIN_NAME=IP, keeping the current
+// values of hosts whenever our hosts file would keep their cached entries
+func writeEnvFile(path string, hosts []*host_config) (wrote bool, err error) {
+	defer func() { err = classifyError(err) }()
+	hosts = pinnedHosts(hosts)
+
+	// read in our current values, it's fine if we haven't written the file yet
+	current_lines := make([]string, 0, 10)
+	current_values := make(map[string]string)
+	in, err := os.Open(path)
+	if err == nil {
+		defer in.Close()
+
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			current_lines = append(current_lines, scanner.Text())
+			if key, value, found := strings.Cut(scanner.Text(), "="); found {
+				current_values[key] = value
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	lines := make([]string, 0, len(hosts))
+	written := make(map[string]string)
+	add := func(name string, ip_address string) {
+		key := envName(name)
+		if existing, exists := written[key]; exists {
+			if existing != name {
+				log.Printf("Warning: %s and %s are both written to %s in %s, keeping %s", existing, name, key, path, existing)
+			}
+			return
+		}
+		written[key] = name
+		lines = append(lines, key+"="+ip_address)
+	}
+
+	// we render the same entries as our block from our current values, so hosts keep them whenever they would there
+	current_mappings := make(map[string][]string)
+	for _, host := range hosts {
+		if value, exists := current_values[envName(host.hostname)]; exists {
+			current_mappings[host.hostname] = []string{value}
+		}
+	}
+	for _, line := range renderEntries(hosts, current_mappings) {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") {
+			add(fields[1], fields[0])
+		}
+	}
+
+	if slices.Equal(lines, current_lines) {
+		return false, nil
+	}
+	logDelta(path, current_lines, lines)
+
+	err = writeAtomically(path, lines, true)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
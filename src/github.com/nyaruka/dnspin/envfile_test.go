@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteEnvFileKeepsCachedValues(t *testing.T) {
+	hosts := []*host_config{
+		{hostname: "a.example.com", dns_server: SYSTEM, ip_address: MISSING, enabled: true, keep_missing: true},
+		{hostname: "b.example.com", dns_server: SYSTEM, ip_address: ERROR, enabled: true},
+		{hostname: "c.example.com", dns_server: SYSTEM, ip_address: NIL, enabled: true},
+		{hostname: "d.example.com", dns_server: SYSTEM, ip_address: MISSING, enabled: true},
+		{hostname: "e.example.com", dns_server: SYSTEM, ip_address: "10.0.0.9", ip_addresses: []string{"10.0.0.9"}, enabled: true},
+	}
+	path := filepath.Join(t.TempDir(), "dnspin.env")
+	current := "DNSPIN_A_EXAMPLE_COM=10.0.0.1\nDNSPIN_B_EXAMPLE_COM=10.0.0.2\nDNSPIN_C_EXAMPLE_COM=10.0.0.3\nDNSPIN_D_EXAMPLE_COM=10.0.0.4\nDNSPIN_E_EXAMPLE_COM=10.0.0.5\n"
+	if err := os.WriteFile(path, []byte(current), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// hosts keep their current values whenever they'd keep their entries in our hosts file
+	if _, err := writeEnvFile(path, hosts); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "DNSPIN_A_EXAMPLE_COM=10.0.0.1\nDNSPIN_B_EXAMPLE_COM=10.0.0.2\nDNSPIN_C_EXAMPLE_COM=10.0.0.3\nDNSPIN_E_EXAMPLE_COM=10.0.0.9\n"
+	if string(contents) != expected {
+		t.Errorf("got %q, expected %q", contents, expected)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+)
+
+// the kinds of errors we return from looking up and writing, which can be checked for with errors.Is
+var ERR_TIMEOUT = errors.New("timeout")
+var ERR_NO_RECORD = errors.New("no record")
+var ERR_NO_SERVERS = errors.New("no servers")
+var ERR_WRITE_DENIED = errors.New("write denied")
+
+// an error of one of our kinds, wrapping the error which caused it
+type kind_error struct {
+	kind error
+	err  error
+}
+
+func (e *kind_error) Error() string {
+	return e.err.Error()
+}
+
+func (e *kind_error) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// returns which of our kinds the passed in error is, or nil if it's none of them
+func errorKind(err error) error {
+	var net_err net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ERR_TIMEOUT), errors.Is(err, context.DeadlineExceeded), errors.As(err, &net_err) && net_err.Timeout():
+		return ERR_TIMEOUT
+	case errors.Is(err, ERR_WRITE_DENIED), errors.Is(err, os.ErrPermission):
+		return ERR_WRITE_DENIED
+	case errors.Is(err, ERR_NO_SERVERS):
+		return ERR_NO_SERVERS
+	case errors.Is(err, ERR_NO_RECORD):
+		return ERR_NO_RECORD
+	}
+	return nil
+}
+
+// returns the passed in error marked as the passed in kind, or as it is if it has no kind
+func withKind(err error, kind error) error {
+	if err == nil || kind == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &kind_error{kind, err}
+}
+
+// returns the passed in error marked as whichever of our kinds it is
+func classifyError(err error) error {
+	return withKind(err, errorKind(err))
+}
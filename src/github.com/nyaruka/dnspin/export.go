@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// loads our config, resolves each host once and prints the block we would write to stdout without
+// writing the hosts file, only reading it for the cached values of any hosts we fail to look up, returning
+// the exit code for the export command
+func exportBlock(source string) int {
+	hosts, err := loadHostConfig(source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", source, err)
+		return 1
+	}
+
+	// we only get one cycle, so look up every host regardless of any limit on how many we look up per cycle
+	*max_lookups = 0
+	resolveHosts(hosts)
+
+	// we render our block just as we would when writing it, keeping any cached values from the current one
+	pin_lines := make([]string, 0)
+	if *hosts_file != "" {
+		_, pin_lines, _, _, err = readHostsFile(*hosts_file, hosts)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", *hosts_file, err)
+			return 1
+		}
+	}
+	block := blockLines(renderEntries(pinnedHosts(hosts), parseMappings(currentEntries(pin_lines))))
+
+	fmt.Println(DNSPIN_BEGIN)
+	for _, line := range block {
+		fmt.Println(line)
+	}
+	fmt.Println(DNSPIN_END)
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// calls the passed in function, returning whatever it printed to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		contents, _ := io.ReadAll(r)
+		output <- string(contents)
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestExportBlock(t *testing.T) {
+	server := startTestServer(t, "a.example.com. 300 IN A 10.0.0.1")
+	setFlag(t, block_footer, true)
+	setFlag(t, max_lookups, 0)
+
+	config := filepath.Join(t.TempDir(), "dnspin.conf")
+	lines := "a.example.com " + server.address + "\nslow.timeout.example.com " + server.address + " timeout=100ms\n"
+	if err := os.WriteFile(config, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, hosts_file, writeTestHosts(t, "127.0.0.1 localhost", DNSPIN_BEGIN, "10.0.0.9\tslow.timeout.example.com", DNSPIN_END))
+
+	var code int
+	output := captureStdout(t, func() { code = exportBlock(config) })
+	if code != 0 {
+		t.Fatalf("got exit code %d, expected 0", code)
+	}
+	exported := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+
+	// we print exactly the block we'd write, keeping the cached value of the host we failed to look up
+	hosts, err := loadHostConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveHosts(hosts)
+	if _, err := writeHostsFile(*hosts_file, hosts); err != nil {
+		t.Fatal(err)
+	}
+	_, written, _, _, err := readHostsFile(*hosts_file, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append([]string{DNSPIN_BEGIN}, written...), DNSPIN_END)
+	if len(exported) != len(expected) || !slices.Equal(currentEntries(exported), currentEntries(expected)) || !isFooter(exported[len(exported)-2]) {
+		t.Errorf("got %q, expected %q", exported, expected)
+	}
+	if !slices.Contains(exported, "10.0.0.9\tslow.timeout.example.com") {
+		t.Errorf("expected the cached value of our failed host, got %q", exported)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// writes the names of our enabled hosts which failed to resolve or have no records to the passed in file,
+// one per line, leaving it untouched if that hasn't changed
+func writeFailedHosts(path string, hosts []*host_config) error {
+	failed := make([]string, 0)
+	for _, host := range hosts {
+		if host.enabled && (host.ip_address == ERROR || host.ip_address == MISSING) {
+			failed = append(failed, host.hostname)
+		}
+	}
+
+	contents := ""
+	if len(failed) > 0 {
+		contents = strings.Join(failed, "\n") + "\n"
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && string(current) == contents {
+		return nil
+	}
+
+	return writeAtomically(path, failed, true)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// our current health, updated at the end of each cycle
+var health_lock sync.Mutex
+var health_ok bool
+var health_reason = "no cycle completed yet"
+
+// updates our health from the state of our hosts, we are healthy once a cycle has completed and, if we
+// have a canary or required hosts, they all resolved
+func updateHealth(hosts []*host_config) {
+	ok, reason := true, "ok"
+
+	if *canary != "" {
+		ok, reason = false, fmt.Sprintf("canary %s is not configured", *canary)
+		for _, host := range hosts {
+			if host.hostname == *canary {
+				if host.enabled && host.resolved() {
+					ok, reason = true, "ok"
+				} else {
+					reason = fmt.Sprintf("canary %s = %s", *canary, host.ip_address)
+				}
+				break
+			}
+		}
+	}
+
+	if ok {
+		for _, host := range hosts {
+			if host.required && host.enabled && !host.resolved() {
+				ok, reason = false, fmt.Sprintf("required host %s = %s", host.hostname, host.ip_address)
+				break
+			}
+		}
+	}
+
+	health_lock.Lock()
+	defer health_lock.Unlock()
+	health_ok = ok
+	health_reason = reason
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health_lock.Lock()
+	ok, reason := health_ok, health_reason
+	health_lock.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, reason)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// the client we send DNS over HTTPS queries with, created on first use so it has our TLS config
+var https_client *http.Client
+var https_client_once sync.Once
+
+// sends the passed in query to the passed in URL over DNS over HTTPS (RFC 8484)
+func exchangeHTTPS(ctx context.Context, m *dns.Msg, url string) (*dns.Msg, time.Duration, error) {
+	https_client_once.Do(func() {
+		https_client = &http.Client{Transport: &http.Transport{TLSClientConfig: tls_config, Proxy: http.ProxyFromEnvironment}}
+	})
+	start := time.Now()
+
+	// queries over HTTPS should have an id of zero so they can be cached
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := https_client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.New(fmt.Sprintf("unexpected status %s", resp.Status))
+	}
+
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r := &dns.Msg{}
+	err = r.Unpack(reply)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, time.Since(start), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// takes an exclusive advisory lock on the passed in file, waiting up to timeout for any other holder to release
+// it, and returns a function which releases it
+func acquireLock(path string, timeout time.Duration) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	contended := false
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+
+		if !contended {
+			log.Printf("Waiting for lock on %s held by another process", path)
+			contended = true
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, withKind(errors.New(fmt.Sprintf("Timed out after %v waiting for lock on %s", timeout, path)), ERR_TIMEOUT)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
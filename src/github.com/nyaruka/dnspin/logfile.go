@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// a log file which can be reopened, letting logrotate move it out from under us
+type reopenable_log struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+// opens the log file at the passed in path for appending
+func openLogFile(path string) (*reopenable_log, error) {
+	l := &reopenable_log{path: path}
+	return l, l.reopen()
+}
+
+func (l *reopenable_log) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.file.Write(p)
+}
+
+// closes and reopens our file, we keep writing to the old one if that fails
+func (l *reopenable_log) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+// a log writer which prefixes each line with an RFC3339 timestamp
+type timestamped_log struct {
+	out io.Writer
+}
+
+func (l *timestamped_log) Write(p []byte) (int, error) {
+	line := make([]byte, 0, len(p)+32)
+	line = time.Now().AppendFormat(line, time.RFC3339)
+	line = append(line, ' ')
+	line = append(line, p...)
+
+	_, err := l.out.Write(line)
+	return len(p), err
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// a DNS server answering over UDP and TCP on the same local port
+type test_server struct {
+	address string
+	records map[string][]dns.RR
+}
+
+// starts a DNS server on a local port answering with the passed in records, which are in zone file format.
+// Questions for .timeout. names are never answered, and anything else without records is NXDOMAIN.
+func startTestServer(t *testing.T, records ...string) *test_server {
+	t.Helper()
+
+	server := &test_server{records: make(map[string][]dns.RR)}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("%s %d", strings.ToLower(rr.Header().Name), rr.Header().Rrtype)
+		server.records[key] = append(server.records[key], rr)
+	}
+
+	packet_conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", packet_conn.LocalAddr().String())
+	if err != nil {
+		packet_conn.Close()
+		t.Fatal(err)
+	}
+	server.address = packet_conn.LocalAddr().String()
+
+	for _, dns_server := range []*dns.Server{{PacketConn: packet_conn, Handler: server}, {Listener: listener, Handler: server}} {
+		started := make(chan struct{})
+		dns_server.NotifyStartedFunc = func() { close(started) }
+		go dns_server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { dns_server.Shutdown() })
+	}
+	return server
+}
+
+func (s *test_server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	question := r.Question[0]
+	name := strings.ToLower(question.Name)
+
+	if strings.Contains(name, ".timeout.") {
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	// follow any CNAME chain, like a recursive resolver would
+	for hops := 0; hops < MAX_CNAME_CHAIN; hops++ {
+		cnames := s.records[fmt.Sprintf("%s %d", name, dns.TypeCNAME)]
+		if len(cnames) == 0 || question.Qtype == dns.TypeCNAME {
+			break
+		}
+		m.Answer = append(m.Answer, cnames[0])
+		name = strings.ToLower(cnames[0].(*dns.CNAME).Target)
+	}
+	m.Answer = append(m.Answer, s.records[fmt.Sprintf("%s %d", name, question.Qtype)]...)
+
+	if len(m.Answer) == 0 {
+		exists := false
+		for key := range s.records {
+			exists = exists || strings.HasPrefix(key, name+" ")
+		}
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+	}
+
+	// truncate answers over UDP which don't fit in the buffer the client advertised, 512 bytes without EDNS0
+	if w.RemoteAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+// sets the passed in flag for the rest of the test
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	original := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = original })
+}
+
+func TestLookupIP(t *testing.T) {
+	server := startTestServer(t,
+		"a.example.com. 300 IN A 10.0.0.1",
+		"multi.example.com. 300 IN A 10.0.0.3",
+		"multi.example.com. 60 IN A 10.0.0.2",
+		"v6.example.com. 300 IN AAAA 2001:db8::1",
+		"both.example.com. 300 IN A 10.0.0.4",
+		"both.example.com. 300 IN AAAA 2001:db8::4",
+		"www.example.com. 300 IN CNAME lb.example.com.",
+		"lb.example.com. 300 IN CNAME lb.cdn.example.net.",
+		"lb.cdn.example.net. 30 IN A 10.0.0.5",
+		"txt.example.com. 300 IN TXT \"no addresses\"",
+	)
+
+	tests := []struct {
+		name         string
+		hostname     string
+		options      []string
+		ip_addresses []string
+		ttl          uint32
+		answers      int
+		aliases      []string
+		no_record    bool
+	}{
+		{name: "A", hostname: "a.example.com", ip_addresses: []string{"10.0.0.1"}, ttl: 300, answers: 1},
+		{name: "several A", hostname: "multi.example.com", options: []string{"max-ips=2"}, ip_addresses: []string{"10.0.0.2", "10.0.0.3"}, ttl: 60, answers: 2},
+		{name: "AAAA", hostname: "v6.example.com", options: []string{"prefer=v6"}, ip_addresses: []string{"2001:db8::1"}, ttl: 300, answers: 1},
+		{name: "AAAA fallback", hostname: "v6.example.com", options: []string{"prefer=v4"}, ip_addresses: []string{"2001:db8::1"}, ttl: 300, answers: 1},
+		{name: "A and AAAA", hostname: "both.example.com", options: []string{"types=A,AAAA", "max-ips=2"}, ip_addresses: []string{"10.0.0.4", "2001:db8::4"}, ttl: 300, answers: 2},
+		{name: "CNAME", hostname: "www.example.com", ip_addresses: []string{"10.0.0.5"}, ttl: 30, answers: 1, aliases: []string{"lb.example.com", "lb.cdn.example.net"}},
+		{name: "query", hostname: "pinned.example.com", options: []string{"query=a.example.com"}, ip_addresses: []string{"10.0.0.1"}, ttl: 300, answers: 1},
+		{name: "NXDOMAIN", hostname: "nope.example.com", no_record: true},
+		{name: "no addresses", hostname: "txt.example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := newHost(test.hostname, server.address)
+			if err := parseHostOptions(host, test.options); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := lookupIP(context.Background(), host, server.address)
+			if errors.Is(err, ERR_NO_RECORD) != test.no_record {
+				t.Fatalf("got %v, expected no_record=%v", err, test.no_record)
+			}
+			if err != nil && !test.no_record {
+				t.Fatal(err)
+			}
+			if test.ip_addresses == nil {
+				if result.ip_address != MISSING {
+					t.Errorf("got %s, expected %s", result.ip_address, MISSING)
+				}
+				return
+			}
+			if result.ip_address != test.ip_addresses[0] || !slices.Equal(result.ip_addresses, test.ip_addresses) {
+				t.Errorf("got %s %v, expected %v", result.ip_address, result.ip_addresses, test.ip_addresses)
+			}
+			if result.ttl != test.ttl || result.answers != test.answers {
+				t.Errorf("got ttl=%d answers=%d, expected ttl=%d answers=%d", result.ttl, result.answers, test.ttl, test.answers)
+			}
+			if !slices.Equal(result.aliases, test.aliases) {
+				t.Errorf("got aliases %v, expected %v", result.aliases, test.aliases)
+			}
+		})
+	}
+}
+
+func TestLookupIPTruncated(t *testing.T) {
+	records := make([]string, 0, 40)
+	expected := make([]string, 0, 40)
+	for i := 1; i <= 40; i++ {
+		records = append(records, fmt.Sprintf("big.example.com. 300 IN A 10.0.1.%d", i))
+		expected = append(expected, fmt.Sprintf("10.0.1.%d", i))
+	}
+	server := startTestServer(t, records...)
+
+	lookup := func(t *testing.T, server string) *lookup_result {
+		host := newHost("big.example.com", server)
+		if err := parseHostOptions(host, []string{"selection=all"}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := lookupIP(context.Background(), host, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortIPStrings(result.ip_addresses)
+		return result
+	}
+
+	// without EDNS0 our answer is cut down to what fits in 512 bytes
+	t.Run("UDP", func(t *testing.T) {
+		result := lookup(t, server.address)
+		if result.answers == 0 || result.answers >= 40 {
+			t.Errorf("got %d answers, expected a truncated answer", result.answers)
+		}
+	})
+
+	t.Run("UDP with EDNS0", func(t *testing.T) {
+		setFlag(t, udp_size, 1232)
+		result := lookup(t, server.address)
+		if !slices.Equal(result.ip_addresses, expected) {
+			t.Errorf("got %v, expected all 40 addresses", result.ip_addresses)
+		}
+	})
+
+	t.Run("TCP", func(t *testing.T) {
+		result := lookup(t, "tcp://"+server.address)
+		if !slices.Equal(result.ip_addresses, expected) {
+			t.Errorf("got %v, expected all 40 addresses", result.ip_addresses)
+		}
+	})
+}
+
+func TestLookupIPTimeout(t *testing.T) {
+	server := startTestServer(t)
+
+	host := newHost("slow.timeout.example.com", server.address)
+	if err := parseHostOptions(host, []string{"timeout=100ms"}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := lookupIP(context.Background(), host, server.address)
+	if !errors.Is(err, ERR_TIMEOUT) {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v to time out, expected around 100ms", elapsed)
+	}
+}
+
+func TestLookupIPMapped(t *testing.T) {
+	server := startTestServer(t,
+		"mapped.example.com. 300 IN AAAA ::ffff:10.0.0.7",
+		"mixed.example.com. 300 IN AAAA ::ffff:10.0.0.8",
+		"mixed.example.com. 300 IN AAAA 2001:db8::8",
+	)
+
+	lookup := func(t *testing.T, hostname string) *lookup_result {
+		host := newHost(hostname, server.address)
+		if err := parseHostOptions(host, []string{"prefer=v6", "max-ips=2"}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := lookupIP(context.Background(), host, server.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// by default we pin mapped addresses in their IPv4 form
+	t.Run("default", func(t *testing.T) {
+		if result := lookup(t, "mapped.example.com"); !slices.Equal(result.ip_addresses, []string{"10.0.0.7"}) {
+			t.Errorf("got %v, expected [10.0.0.7]", result.ip_addresses)
+		}
+		if result := lookup(t, "mixed.example.com"); !slices.Equal(result.ip_addresses, []string{"10.0.0.8", "2001:db8::8"}) {
+			t.Errorf("got %v, expected [10.0.0.8 2001:db8::8]", result.ip_addresses)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		setFlag(t, reject_mapped, true)
+		if result := lookup(t, "mapped.example.com"); result.ip_address != MISSING {
+			t.Errorf("got %v, expected %s", result.ip_addresses, MISSING)
+		}
+		if result := lookup(t, "mixed.example.com"); !slices.Equal(result.ip_addresses, []string{"2001:db8::8"}) {
+			t.Errorf("got %v, expected [2001:db8::8]", result.ip_addresses)
+		}
+	})
+}
+
+// sorts the passed in addresses numerically
+func sortIPStrings(ip_addresses []string) {
+	slices.SortFunc(ip_addresses, func(a, b string) int {
+		return slices.Compare(net.ParseIP(a).To16(), net.ParseIP(b).To16())
+	})
+}
+
+func TestTrailingDots(t *testing.T) {
+	server := startTestServer(t, "a.example.com. 300 IN A 10.0.0.1", "b.example.com. 300 IN A 10.0.0.2")
+
+	config := fmt.Sprintf("a.example.com. %s\n%s b.example.com.\n", server.address, server.address)
+	hosts, err := parseHostConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 || hosts[0].hostname != "a.example.com" || hosts[1].hostname != "b.example.com" {
+		t.Fatalf("got %d hosts, expected a.example.com and b.example.com without trailing dots", len(hosts))
+	}
+
+	// the same host with and without a trailing dot is the same host
+	hosts, err = parseHostConfig(strings.NewReader(config + "a.example.com " + server.address + "\n"))
+	if err != nil || len(hosts) != 2 {
+		t.Fatalf("got %d hosts and err=%v, expected the duplicate to be ignored", len(hosts), err)
+	}
+
+	// we query the right name and write it without the dot
+	for _, host := range hosts {
+		resolveHost(context.Background(), host, time.Now())
+	}
+	path := writeTestHosts(t, "127.0.0.1 localhost")
+	if _, err := writeHostsFile(path, hosts); err != nil {
+		t.Fatal(err)
+	}
+	_, pin_lines, _, _, err := readHostsFile(path, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1\ta.example.com", "10.0.0.2\tb.example.com"}
+	if !slices.Equal(pin_lines, expected) {
+		t.Errorf("got %q, expected %q", pin_lines, expected)
+	}
+
+	// a hostname which is only a dot is invalid
+	if _, err := parseHostConfig(strings.NewReader(". " + server.address + "\n")); err == nil {
+		t.Errorf("expected an error for an empty hostname")
+	}
+}
+
+func TestShowSource(t *testing.T) {
+	server := startTestServer(t, "a.example.com. 300 IN A 10.0.0.1")
+	setFlag(t, show_source, true)
+
+	// nothing listens on our first server, so it's our second which answers
+	servers := "tcp://127.0.0.1:1," + server.address
+	host := newHost("a.example.com", servers)
+	resolveHost(context.Background(), host, time.Now())
+
+	lines := renderEntries([]*host_config{host}, make(map[string][]string))
+	expected := []string{"# via " + server.address, "10.0.0.1\ta.example.com"}
+	if !slices.Equal(lines, expected) {
+		t.Errorf("got %q, expected %q", lines, expected)
+	}
+
+	// which is carried over when our config is reloaded unchanged
+	reloaded := newHost("a.example.com", servers)
+	carryOverState([]*host_config{host}, []*host_config{reloaded})
+	if reloaded.answered_by != server.address {
+		t.Errorf("got %s, expected %s to be carried over", reloaded.answered_by, server.address)
+	}
+}
+
+func TestResolveHostNoRecord(t *testing.T) {
+	empty := startTestServer(t)
+	server := startTestServer(t, "a.example.com. 300 IN A 10.0.0.1")
+
+	// a server telling us a name doesn't exist has answered, so it's missing rather than an error and we
+	// don't ask our next server
+	host := newHost("a.example.com", empty.address+","+server.address)
+	_, answered_by, err := lookupHost(context.Background(), host)
+	if !errors.Is(err, ERR_NO_RECORD) || answered_by != empty.address {
+		t.Errorf("got %v via %s, expected no record via %s", err, answered_by, empty.address)
+	}
+	resolveHost(context.Background(), host, time.Now())
+	if host.ip_address != MISSING {
+		t.Errorf("got %s, expected %s", host.ip_address, MISSING)
+	}
+
+	// when asking every server at once, an answer that the name doesn't exist is still an answer rather than an error
+	if err := parseHostOptions(host, []string{"fastest"}); err != nil {
+		t.Fatal(err)
+	}
+	resolveHost(context.Background(), host, time.Now())
+	if host.ip_address != MISSING && host.ip_address != "10.0.0.1" {
+		t.Errorf("got %s, expected the answer of whichever server was fastest", host.ip_address)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	server := startTestServer(t, "a.example.com. 300 IN A 10.0.0.1")
+
+	// a host without any records hasn't resolved, so we keep warming up until we time out
+	missing := newHost("nope.example.com", server.address)
+	if warmUp([]*host_config{missing}, 0) {
+		t.Errorf("expected a missing host not to end our warm-up")
+	}
+
+	if !warmUp([]*host_config{missing, newHost("a.example.com", server.address)}, time.Second) {
+		t.Errorf("expected a host resolving to an address to end our warm-up")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// the signals and requests our main loop acts on between cycles
+type loop_signals struct {
+	reload         <-chan os.Signal
+	shutdown       <-chan os.Signal
+	dump           <-chan os.Signal
+	pause          <-chan os.Signal
+	admin          <-chan *admin_request
+	config_changed <-chan struct{}
+}
+
+// runs our main loop, looking up and writing our hosts each cycle until we're told to shut down
+func run(hosts []*host_config, loaded_on time.Time, logs *reopenable_log, signals loop_signals) {
+	interval := CYCLE_INTERVAL
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	// reloads our config, returning whether to start a new cycle to look up our hosts, which we don't if
+	// we're only looking up the hosts which changed
+	reloadConfig := func() bool {
+		reloaded := reloadHostConfig(*config_source, hosts)
+		if *names_file != "" {
+			reloaded = refreshNames(*names_file, reloaded, hosts)
+		}
+		loaded_on = time.Now()
+		if !*reload_changed_only {
+			hosts = reloaded
+			return true
+		}
+
+		changed := carryOverState(hosts, reloaded)
+		hosts = reloaded
+		if len(changed) > 0 {
+			log.Printf("Looking up %d new or changed hosts", len(changed))
+			resolveHosts(changed)
+			writeTargets(hosts, false)
+			updateHealth(hosts)
+		}
+		return false
+	}
+
+	first_cycle := true
+	for {
+		// signals are only handled between cycles, so a write is never interrupted and our hosts are
+		// never swapped out from under a cycle in progress
+		if *names_file != "" {
+			hosts = refreshNames(*names_file, hosts, hosts)
+		}
+		looked_up, answered := resolveHosts(hosts)
+		writeTargets(hosts, first_cycle)
+		first_cycle = false
+		if *failed_path != "" {
+			err := writeFailedHosts(*failed_path, hosts)
+			if err != nil {
+				log.Printf("Error writing failed hosts to %s: %v", *failed_path, err)
+			}
+		}
+		updateHealth(hosts)
+
+		// if none of our lookups got an answer we're likely in an outage, back off until we recover
+		if looked_up > 0 && answered == 0 && *outage_backoff > 0 {
+			interval = min(time.Duration(float64(interval)**outage_backoff_factor), *outage_backoff)
+			interval = max(interval, CYCLE_INTERVAL)
+			log.Printf("No lookups succeeded, backing off to every %v", interval)
+		} else if answered > 0 && interval != CYCLE_INTERVAL {
+			interval = CYCLE_INTERVAL
+			log.Printf("Lookups recovered, back to every %v", interval)
+		}
+		timer.Reset(interval)
+
+		// a pending shutdown always wins over a pending reload
+		select {
+		case sig := <-signals.shutdown:
+			log.Printf("Received %v, shutting down", sig)
+			return
+		default:
+		}
+
+		// wait for our next cycle, reloading our config if asked to or it's time to refresh
+	wait:
+		for {
+			select {
+			case sig := <-signals.shutdown:
+				log.Printf("Received %v, shutting down", sig)
+				return
+			case <-signals.pause:
+				// our next cycle writes the current state of our hosts once we're resumed
+				paused = !paused
+				if paused {
+					log.Printf("Received SIGUSR2, pausing writes")
+				} else {
+					log.Printf("Received SIGUSR2, resuming writes")
+				}
+			case <-signals.dump:
+				// dumping our state doesn't start a new cycle
+				err := dumpState(*state_path, hosts)
+				if err != nil {
+					log.Printf("Error dumping state: %v", err)
+				}
+			case request := <-signals.admin:
+				// reloading or confirming a large removal starts a new cycle, everything else is answered right away
+				if request.command == "confirm" {
+					log.Printf("Allowing our next write to remove more entries than our limits")
+					shrink_confirmed = true
+					request.reply <- "confirmed, writing"
+					break wait
+				}
+				if request.command == "reload" {
+					new_cycle := reloadConfig()
+					request.reply <- fmt.Sprintf("reloaded, %d hosts configured", len(hosts))
+					if new_cycle {
+						break wait
+					}
+					continue
+				}
+				request.reply <- adminCommand(request, hosts)
+			case <-signals.reload:
+				if logs != nil {
+					err := logs.reopen()
+					if err != nil {
+						log.Printf("Error reopening log file %s: %v", *log_path, err)
+					}
+				}
+				if reloadConfig() {
+					break wait
+				}
+			case <-signals.config_changed:
+				log.Printf("%s changed, reloading", *config_source)
+				if reloadConfig() {
+					break wait
+				}
+			case <-timer.C:
+				if *config_refresh > 0 && time.Since(loaded_on) >= *config_refresh {
+					reloadConfig()
+				}
+				break wait
+			}
+		}
+	}
+}
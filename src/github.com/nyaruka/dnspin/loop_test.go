@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// the channels we send our test signals to a running loop on
+type test_loop struct {
+	reload   chan os.Signal
+	shutdown chan os.Signal
+	done     chan struct{}
+}
+
+// starts our main loop with the passed in hosts, returning the channels to signal it on, any signals already
+// sent being handled after its first cycle
+func startTestLoop(t *testing.T, hosts []*host_config, pending ...os.Signal) *test_loop {
+	t.Helper()
+	loop := &test_loop{reload: make(chan os.Signal, 1), shutdown: make(chan os.Signal, 1), done: make(chan struct{})}
+	for _, sig := range pending {
+		if sig == syscall.SIGHUP {
+			loop.reload <- sig
+		} else {
+			loop.shutdown <- sig
+		}
+	}
+
+	go func() {
+		run(hosts, time.Now(), nil, loop_signals{reload: loop.reload, shutdown: loop.shutdown})
+		close(loop.done)
+	}()
+	t.Cleanup(func() {
+		select {
+		case loop.shutdown <- syscall.SIGTERM:
+		default:
+		}
+		<-loop.done
+	})
+	return loop
+}
+
+// waits for our loop to return after being shut down
+func (l *test_loop) waitForShutdown(t *testing.T) {
+	t.Helper()
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop didn't shut down")
+	}
+}
+
+// waits for the passed in file to contain the passed in text
+func waitForContents(t *testing.T, path string, text string) {
+	t.Helper()
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		contents, _ := os.ReadFile(path)
+		if strings.Contains(string(contents), text) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	contents, _ := os.ReadFile(path)
+	t.Fatalf("%s never contained %q, contents: %q", path, text, contents)
+}
+
+// sets up a config and hosts file for our loop, returning the hosts initially configured
+func setupTestLoop(t *testing.T) (*test_server, string, []*host_config) {
+	server := startTestServer(t, "a.example.com. 300 IN A 10.0.0.1", "b.example.com. 300 IN A 10.0.0.2")
+
+	dir := t.TempDir()
+	setFlag(t, config_source, filepath.Join(dir, "dnspin.conf"))
+	setFlag(t, hosts_file, writeTestHosts(t, "127.0.0.1 localhost"))
+
+	writeTestConfig(t, "a.example.com "+server.address)
+	hosts, err := loadHostConfig(*config_source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, *hosts_file, hosts
+}
+
+func writeTestConfig(t *testing.T, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(*config_source, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoopPendingShutdownWinsOverReload(t *testing.T) {
+	server, path, hosts := setupTestLoop(t)
+
+	// a reload and a shutdown arrive during our first cycle, so we finish it and shut down without reloading
+	writeTestConfig(t, "a.example.com "+server.address, "b.example.com "+server.address)
+	loop := startTestLoop(t, hosts, syscall.SIGHUP, syscall.SIGTERM)
+	loop.waitForShutdown(t)
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "10.0.0.1\ta.example.com\n"+DNSPIN_END) {
+		t.Errorf("expected a complete block with only our original host, got %q", contents)
+	}
+}
+
+func TestLoopInterleavedSignals(t *testing.T) {
+	server, path, hosts := setupTestLoop(t)
+
+	loop := startTestLoop(t, hosts)
+	waitForContents(t, path, "10.0.0.1\ta.example.com")
+
+	// a reload swaps in our new hosts between cycles, and the next cycle writes them
+	writeTestConfig(t, "a.example.com "+server.address, "b.example.com "+server.address)
+	loop.reload <- syscall.SIGHUP
+	waitForContents(t, path, "10.0.0.2\tb.example.com")
+
+	// whether a reload immediately followed by a shutdown is handled first, we never leave a partial block
+	writeTestConfig(t, "b.example.com "+server.address)
+	loop.reload <- syscall.SIGHUP
+	loop.shutdown <- syscall.SIGTERM
+	loop.waitForShutdown(t)
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(contents), DNSPIN_BEGIN) != 1 || strings.Count(string(contents), DNSPIN_END) != 1 {
+		t.Errorf("expected a single complete block, got %q", contents)
+	}
+}
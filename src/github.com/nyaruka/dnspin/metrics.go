@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// round trip time of our DNS queries, labeled by the server we asked
+var lookup_duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "dnspin_lookup_duration_seconds",
+	Help:    "Round trip time of DNS lookups by server.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+}, []string{"server"})
+
+// the tags configured on each host, always 1, for joining against other metrics in dashboards
+var host_tags = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "dnspin_host_tag_info",
+	Help: "Tags configured on each host.",
+}, []string{"host", "tag", "value"})
+
+// failed writes of each of our targets
+var write_errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "dnspin_write_errors_total",
+	Help: "Failed writes of each output target.",
+}, []string{"target"})
+
+// when each of our targets was last written or found to be in sync, starting from when we started
+var last_writes = make(map[string]time.Time)
+var last_writes_lock sync.Mutex
+var started_on = time.Now()
+
+// how long since the target we've gone longest without successfully writing was last written
+var write_age = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "dnspin_seconds_since_last_write",
+	Help: "Seconds since the least recently successful output target was written or found in sync.",
+}, func() float64 {
+	last_writes_lock.Lock()
+	defer last_writes_lock.Unlock()
+
+	oldest := time.Now()
+	for _, target := range outputTargets() {
+		last_write, exists := last_writes[target.path]
+		if !exists {
+			last_write = started_on
+		}
+		if last_write.Before(oldest) {
+			oldest = last_write
+		}
+	}
+	return time.Since(oldest).Seconds()
+})
+
+func init() {
+	prometheus.MustRegister(lookup_duration)
+	prometheus.MustRegister(host_tags)
+	prometheus.MustRegister(write_errors)
+	prometheus.MustRegister(write_age)
+}
+
+// records the result of writing the passed in target
+func recordWrite(path string, err error) {
+	if err != nil {
+		write_errors.WithLabelValues(path).Inc()
+		return
+	}
+
+	last_writes_lock.Lock()
+	defer last_writes_lock.Unlock()
+	last_writes[path] = time.Now()
+}
+
+// replaces our tag metrics with the tags of the passed in hosts
+func updateTagMetrics(hosts []*host_config) {
+	host_tags.Reset()
+	for _, host := range hosts {
+		for name, value := range host.tags {
+			host_tags.WithLabelValues(host.hostname, name, value).Set(1)
+		}
+	}
+}
+
+// starts serving our metrics and health check on the passed in address in the background
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealth)
+
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Printf("Error serving metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+)
+
+// returns the passed in hosts with those from our names file replaced by the hostnames currently listed in it,
+// carrying over the state of any already in the previous hosts. Hosts in our config take precedence over the
+// same hostname in the names file, and if it can't be read we keep the hostnames we last read from it
+func refreshNames(path string, hosts []*host_config, previous []*host_config) []*host_config {
+	listed := make(map[string]*host_config)
+	configured := make([]*host_config, 0, len(hosts))
+	for _, host := range previous {
+		if host.from_names {
+			listed[host.hostname] = host
+		}
+	}
+	for _, host := range hosts {
+		if !host.from_names {
+			configured = append(configured, host)
+		}
+	}
+
+	names, err := readNames(path)
+	if err != nil {
+		log.Printf("Error reading names file %s, keeping %d names from it: %v", path, len(listed), err)
+		for _, host := range previous {
+			if host.from_names && !hasHost(configured, host.hostname) {
+				configured = append(configured, host)
+			}
+		}
+		return configured
+	}
+
+	refreshed := configured
+	for _, name := range names {
+		if hasHost(refreshed, name) {
+			continue
+		}
+		host, exists := listed[name]
+		if !exists {
+			host = newHost(name, *names_server)
+			host.from_names = true
+		}
+		refreshed = append(refreshed, host)
+	}
+	if len(refreshed)-len(configured) != len(listed) {
+		log.Printf("Read %s, %d names listed", path, len(refreshed)-len(configured))
+	}
+	return refreshed
+}
+
+// reads the hostnames listed one per line in the passed in file, skipping blank lines, comments and any
+// lines which aren't a single hostname
+func readNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make([]string, 0)
+	lineno := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineno += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		name := strings.TrimSuffix(fields[0], ".")
+		if len(fields) > 1 || name == "" || isServerAddress(name) {
+			log.Printf("Warning: skipping invalid name on line %d of %s: %s", lineno, path, line)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
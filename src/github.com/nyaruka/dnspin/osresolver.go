@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// the server for hosts we resolve using Go's resolver, so just as the rest of the system would, honoring
+// nsswitch.conf and any caching rather than querying a server ourselves
+const OS = "os"
+
+// looks up the passed in host using Go's resolver, which doesn't tell us TTLs or which server answered
+func lookupOS(ctx context.Context, host *host_config) (*lookup_result, error) {
+	ctx, cancel := context.WithTimeout(ctx, host.dnsTimeout())
+	defer cancel()
+
+	start := time.Now()
+	found, err := net.DefaultResolver.LookupIP(ctx, "ip", host.queryName())
+	rtt := time.Since(start)
+
+	// Go's resolver reports a name which doesn't exist the same as one without addresses, so both are just missing
+	var dns_err *net.DNSError
+	if errors.As(err, &dns_err) && dns_err.IsNotFound {
+		return &lookup_result{ip_address: MISSING, rtt: rtt}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// we ask for both families at once, so pick out the ones we'd have queried for, either all of the
+	// configured types or the first which has any addresses
+	qtypes := host.queryTypes()
+	union := len(host.query_types) > 0
+	ips := make([]net.IP, 0, len(found))
+	for _, qtype := range qtypes {
+		for _, ip := range found {
+			if (ip.To4() != nil) != (qtype == dns.TypeA) {
+				continue
+			}
+			if !usableIP(ip) {
+				log.Printf("Warning: ignoring unusable address %s for %s", ip, host.hostname)
+				continue
+			}
+			if qtype == dns.TypeA {
+				ip = ip.To4()
+			}
+			if !slices.ContainsFunc(ips, ip.Equal) {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 && !union {
+			break
+		}
+	}
+
+	if len(ips) == 0 {
+		return &lookup_result{ip_address: MISSING, rtt: rtt}, nil
+	}
+
+	return selectResult(host, ips, 0, rtt, nil), nil
+}
+
+// checks whether the passed in IP maps back to the passed in host using Go's resolver
+func checkOSPTR(ctx context.Context, host string, ip string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, *dns_timeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	var dns_err *net.DNSError
+	if errors.As(err, &dns_err) && dns_err.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if strings.EqualFold(dns.Fqdn(name), dns.Fqdn(host)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
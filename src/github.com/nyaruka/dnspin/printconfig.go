@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/miekg/dns"
+)
+
+// the effective configuration of a host once defaults have been applied
+type effective_host struct {
+	Hostname string   `json:"hostname"`
+	Query    string   `json:"query"`
+	Servers  []string `json:"servers"`
+	Type     string   `json:"type"`
+	Class    string   `json:"class"`
+	MaxIPs   int      `json:"max_ips"`
+	Enabled  bool     `json:"enabled"`
+	Interval string   `json:"interval"`
+}
+
+func (h *host_config) effective() effective_host {
+	qtype := recordTypes(h.queryTypes())
+	if h.axfr {
+		qtype = "AXFR"
+	}
+	return effective_host{
+		Hostname: h.hostname,
+		Query:    h.queryName(),
+		Servers:  h.servers(),
+		Type:     qtype,
+		Class:    dns.ClassToString[h.queryClass()],
+		MaxIPs:   h.maxIPs(),
+		Enabled:  h.enabled,
+		Interval: CYCLE_INTERVAL.String(),
+	}
+}
+
+// formats the passed in record types as a list in order
+func recordTypes(qtypes []uint16) string {
+	names := make([]string, len(qtypes))
+	for i, qtype := range qtypes {
+		names[i] = dns.TypeToString[qtype]
+	}
+	return strings.Join(names, ",")
+}
+
+// loads our config and prints the effective config of each host as a table or JSON, returning the
+// exit code for the print-config command
+func printConfig(source string, format string) int {
+	hosts, err := loadHostConfig(source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", source, err)
+		return 1
+	}
+
+	effective := make([]effective_host, len(hosts))
+	for i, host := range hosts {
+		effective[i] = host.effective()
+	}
+
+	switch format {
+	case "", "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "HOSTNAME\tQUERY\tSERVERS\tTYPE\tCLASS\tMAX IPS\tENABLED\tINTERVAL")
+		for _, h := range effective {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", h.Hostname, h.Query, strings.Join(h.Servers, ","), h.Type, h.Class,
+				h.MaxIPs, strconv.FormatBool(h.Enabled), h.Interval)
+		}
+		w.Flush()
+	case "json":
+		out, err := json.MarshalIndent(effective, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding config: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(out))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %s, must be table or json\n", format)
+		return 1
+	}
+	return 0
+}
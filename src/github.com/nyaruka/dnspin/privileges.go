@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// the access(2) mode for checking write permission
+const W_OK = 0x2
+
+// drops our privileges to those of the passed in user and their primary group
+//
+// This should be called once anything needing root (binding ports, opening the log file) is done. Note that
+// replacing the hosts file means creating a temp file and renaming it into place, which requires write access
+// to the temp directory as well as to the directory containing the hosts file, for example by making /etc/hosts
+// writable by the user's group and pointing --temp-dir at a directory the user owns on the same filesystem.
+func dropPrivileges(username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	// group first, as once we've changed user we no longer can
+	err = syscall.Setgroups([]int{gid})
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// checks that we can still write the passed in file atomically, returning a descriptive error if not
+func checkWriteAccess(path string) error {
+	out_dir := *temp_dir
+	if out_dir == "" {
+		out_dir = filepath.Dir(path)
+	}
+
+	// we need to be able to create our temp file
+	out, err := ioutil.TempFile(out_dir, filepath.Base(path))
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot create temp files in %s: %v", out_dir, err))
+	}
+	out.Close()
+	os.Remove(out.Name())
+
+	// and to rename it over our target, which needs write access to its directory
+	err = syscall.Access(filepath.Dir(path), W_OK)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot replace files in %s: %v", filepath.Dir(path), err))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// the code we close our connections with, DOQ_NO_ERROR from RFC 9250
+const DOQ_NO_ERROR = 0
+
+// sends the passed in query to the server at addr over DNS over QUIC (RFC 9250), using a new connection
+// and a single stream as the RFC describes
+func exchangeQUIC(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	config := tls_config.Clone()
+	config.NextProtos = []string{"doq"}
+
+	conn, err := quic.DialAddr(ctx, addr, config, &quic.Config{})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.CloseWithError(DOQ_NO_ERROR, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if deadline, exists := ctx.Deadline(); exists {
+		stream.SetDeadline(deadline)
+	}
+
+	// queries over QUIC always have an id of zero and are prefixed with their length like over TCP
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed))))
+	if err == nil {
+		_, err = stream.Write(packed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// closing our side of the stream tells the server we have nothing more to send
+	stream.Close()
+
+	reply, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(reply) < 2 || int(binary.BigEndian.Uint16(reply)) != len(reply)-2 {
+		return nil, 0, errors.New(fmt.Sprintf("invalid DNS over QUIC reply from %s", addr))
+	}
+
+	r := &dns.Msg{}
+	err = r.Unpack(reply[2:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, time.Since(start), nil
+}
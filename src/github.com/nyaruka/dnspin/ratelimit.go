@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// our per server query limiters, created on first use
+var limiters = make(map[string]*rate.Limiter)
+var limiters_lock sync.Mutex
+
+// per server overrides of --server-qps, parsed from --server-qps-overrides
+var qps_overrides = make(map[string]float64)
+
+// returns the limiter for queries to the passed in server, or nil if they aren't limited
+func serverLimiter(server string) *rate.Limiter {
+	qps, overridden := qps_overrides[server]
+	if !overridden {
+		qps = *server_qps
+	}
+	if qps <= 0 {
+		return nil
+	}
+
+	limiters_lock.Lock()
+	defer limiters_lock.Unlock()
+
+	limiter, exists := limiters[server]
+	if !exists {
+		limiter = rate.NewLimiter(rate.Limit(qps), 1)
+		limiters[server] = limiter
+	}
+	return limiter
+}
+
+// parses a list of per server limits in the form server=qps,server=qps
+func parseQPSOverrides(spec string) (map[string]float64, error) {
+	overrides := make(map[string]float64)
+	if spec == "" {
+		return overrides, nil
+	}
+
+	for _, override := range strings.Split(spec, ",") {
+		server, value, found := strings.Cut(override, "=")
+		qps, err := strconv.ParseFloat(value, 64)
+		if !found || err != nil || qps < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid server limit %s", override))
+		}
+		overrides[server] = qps
+	}
+	return overrides, nil
+}
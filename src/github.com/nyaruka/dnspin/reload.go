@@ -0,0 +1,33 @@
+package main
+
+// carries the state of each host in our old config over to the same host in our reloaded config, if it
+// was configured exactly the same way, returning the hosts which are new or have changed
+func carryOverState(old_hosts []*host_config, new_hosts []*host_config) []*host_config {
+	old_configs := make(map[string]*host_config, len(old_hosts))
+	for _, host := range old_hosts {
+		old_configs[host.hostname] = host
+	}
+
+	changed := make([]*host_config, 0)
+	for _, host := range new_hosts {
+		old, exists := old_configs[host.hostname]
+		if !exists || old.config != host.config {
+			changed = append(changed, host)
+			continue
+		}
+
+		host.ip_address = old.ip_address
+		host.ip_addresses = old.ip_addresses
+		host.aliases = old.aliases
+		host.zone_entries = old.zone_entries
+		host.rtt = old.rtt
+		host.answered_by = old.answered_by
+		host.ttl = old.ttl
+		host.shown_ttl = old.shown_ttl
+		host.next_query = old.next_query
+		host.last_success = old.last_success
+		host.changed_on = old.changed_on
+		host.conflicted = old.conflicted
+	}
+	return changed
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// the nameservers from our resolver config, loaded on first use
+var system_config *dns.ClientConfig
+var system_rotation int
+var system_lock sync.Mutex
+
+// returns the nameservers from our resolver config to try in order, rotating the order on each
+// call if we've been asked to
+func systemResolvers() []string {
+	system_lock.Lock()
+	defer system_lock.Unlock()
+
+	if system_config == nil {
+		config, err := dns.ClientConfigFromFile(*resolv_conf)
+		if err != nil {
+			log.Printf("Error loading %s: %v", *resolv_conf, err)
+			return nil
+		}
+		system_config = config
+	}
+
+	servers := system_config.Servers
+	if !*rotate_resolvers || len(servers) < 2 {
+		return servers
+	}
+
+	start := system_rotation % len(servers)
+	system_rotation += 1
+
+	rotated := make([]string, 0, len(servers))
+	rotated = append(rotated, servers[start:]...)
+	rotated = append(rotated, servers[:start]...)
+	return rotated
+}
+
+// clears our loaded resolver config so it is reread on next use
+func reloadSystemResolvers() {
+	system_lock.Lock()
+	defer system_lock.Unlock()
+
+	system_config = nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"slices"
+)
+
+// the ways we can select which of the addresses returned for a host to pin
+var selections = []string{"first", "random", "round-robin", "cidr", "all"}
+
+// returns how we select which addresses to pin for this host, which is by our preferred networks if we
+// have any, otherwise the first returned
+func (h *host_config) selectionMode() string {
+	if h.selection != "" {
+		return h.selection
+	}
+	if len(h.preferCIDRs()) > 0 {
+		return "cidr"
+	}
+	return "first"
+}
+
+// selects which of the passed in addresses to pin for the passed in host, up to its max:
+//
+//	first       - the first returned, sorted numerically when pinning more than one so they're stable
+//	random      - at random
+//	round-robin - sorted numerically, starting at the next one on each lookup
+//	cidr        - those in our preferred networks first, in order of preference
+//	all         - every address, sorted numerically
+func selectIPs(host *host_config, ips []net.IP) []net.IP {
+	max_ips := host.maxIPs()
+
+	switch host.selectionMode() {
+	case "random":
+		rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	case "round-robin":
+		sortIPs(ips)
+		start := host.rotation % len(ips)
+		ips = slices.Concat(ips[start:], ips[:start])
+	case "cidr":
+		if max_ips > 1 {
+			sortIPs(ips)
+		}
+		preferIPs(ips, host.preferCIDRs())
+	case "all":
+		sortIPs(ips)
+		return ips
+	default:
+		if max_ips > 1 {
+			sortIPs(ips)
+		}
+	}
+
+	if len(ips) > max_ips {
+		ips = ips[:max_ips]
+	}
+	return ips
+}
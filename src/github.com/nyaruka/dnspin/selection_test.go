@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// parses the passed in addresses, failing the test if any are invalid
+func parseTestIPs(t *testing.T, ip_addresses ...string) []net.IP {
+	t.Helper()
+	ips := make([]net.IP, len(ip_addresses))
+	for i, ip_address := range ip_addresses {
+		ips[i] = net.ParseIP(ip_address)
+		if ips[i] == nil {
+			t.Fatalf("invalid test address %s", ip_address)
+		}
+	}
+	return ips
+}
+
+func ipStrings(ips []net.IP) []string {
+	strs := make([]string, len(ips))
+	for i, ip := range ips {
+		strs[i] = ip.String()
+	}
+	return strs
+}
+
+func TestSelectIPs(t *testing.T) {
+	answers := []string{"10.0.0.3", "192.168.1.1", "10.0.0.1", "172.16.0.1", "10.0.0.2"}
+
+	tests := []struct {
+		name     string
+		options  []string
+		rotation int
+		expected []string
+	}{
+		{name: "default is first", expected: []string{"10.0.0.3"}},
+		{name: "first", options: []string{"selection=first"}, expected: []string{"10.0.0.3"}},
+		{name: "first sorted with max-ips", options: []string{"selection=first", "max-ips=3"}, expected: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{name: "all", options: []string{"selection=all"}, expected: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "172.16.0.1", "192.168.1.1"}},
+		{name: "all ignores max-ips", options: []string{"selection=all", "max-ips=2"}, expected: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "172.16.0.1", "192.168.1.1"}},
+		{name: "round-robin first lookup", options: []string{"selection=round-robin"}, expected: []string{"10.0.0.1"}},
+		{name: "round-robin second lookup", options: []string{"selection=round-robin"}, rotation: 1, expected: []string{"10.0.0.2"}},
+		{name: "round-robin wraps", options: []string{"selection=round-robin"}, rotation: 5, expected: []string{"10.0.0.1"}},
+		{name: "round-robin with max-ips", options: []string{"selection=round-robin", "max-ips=3"}, rotation: 3, expected: []string{"172.16.0.1", "192.168.1.1", "10.0.0.1"}},
+		{name: "cidr", options: []string{"selection=cidr", "prefer-cidrs=192.168.0.0/16,172.16.0.0/12"}, expected: []string{"192.168.1.1"}},
+		{name: "cidr with max-ips", options: []string{"selection=cidr", "prefer-cidrs=192.168.0.0/16,172.16.0.0/12", "max-ips=4"}, expected: []string{"192.168.1.1", "172.16.0.1", "10.0.0.1", "10.0.0.2"}},
+		{name: "cidr by default with prefer-cidrs", options: []string{"prefer-cidrs=172.16.0.0/12", "max-ips=2"}, expected: []string{"172.16.0.1", "10.0.0.1"}},
+		{name: "cidr without a match", options: []string{"selection=cidr", "prefer-cidrs=10.1.0.0/16", "max-ips=2"}, expected: []string{"10.0.0.1", "10.0.0.2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := newHost("pool.example.com", SYSTEM)
+			if err := parseHostOptions(host, test.options); err != nil {
+				t.Fatal(err)
+			}
+			host.rotation = test.rotation
+
+			selected := ipStrings(selectIPs(host, parseTestIPs(t, answers...)))
+			if !slices.Equal(selected, test.expected) {
+				t.Errorf("got %v, expected %v", selected, test.expected)
+			}
+		})
+	}
+}
+
+func TestSelectIPsRandom(t *testing.T) {
+	answers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+
+	host := newHost("pool.example.com", SYSTEM)
+	if err := parseHostOptions(host, []string{"selection=random", "max-ips=2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// we always pick distinct addresses from our answers, and given enough lookups pick each of them
+	seen := make(map[string]bool)
+	for range 200 {
+		selected := ipStrings(selectIPs(host, parseTestIPs(t, answers...)))
+		if len(selected) != 2 || selected[0] == selected[1] {
+			t.Fatalf("got %v, expected 2 distinct addresses", selected)
+		}
+		for _, ip_address := range selected {
+			if !slices.Contains(answers, ip_address) {
+				t.Fatalf("got %s, which isn't one of our answers", ip_address)
+			}
+			seen[ip_address] = true
+		}
+	}
+	if len(seen) != len(answers) {
+		t.Errorf("only selected %d of %d addresses", len(seen), len(answers))
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	host := newHost("pool.example.com", SYSTEM)
+	if err := parseHostOptions(host, []string{"selection=fastest"}); err == nil {
+		t.Errorf("expected an error for an unknown selection")
+	}
+	if err := parseHostOptions(newHost("pool.example.com", SYSTEM), []string{"selection=cidr"}); err == nil {
+		t.Errorf("expected an error for selection=cidr without prefer-cidrs")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// the host and server we test against when not given any
+const SELFTEST_HOST = "one.one.one.one"
+const SELFTEST_SERVER = "1.1.1.1"
+
+// checks that we can parse a config line for the passed in host, look it up using the server and render
+// an entry for it which maps back to the addresses we found, without touching any hosts file, returning
+// the exit code for the selftest command
+func selfTest(hostname string, server string) int {
+	if hostname == "" {
+		hostname = SELFTEST_HOST
+	}
+	if server == "" {
+		server = SELFTEST_SERVER
+	}
+
+	hosts, err := parseHostConfig(strings.NewReader(hostname + " " + server))
+	if err != nil {
+		fmt.Printf("FAIL: unable to parse config for %s: %v\n", hostname, err)
+		return 1
+	}
+	fmt.Printf("ok: parsed config for %s via %s\n", hostname, server)
+
+	resolveHosts(hosts)
+	host := hosts[len(hosts)-1]
+	if !host.resolved() {
+		fmt.Printf("FAIL: unable to look up %s via %s\n", hostname, server)
+		return 1
+	}
+	fmt.Printf("ok: looked up %s = %s (%v)\n", hostname, strings.Join(host.ip_addresses, ","), host.rtt)
+
+	block := renderEntries(hosts, make(map[string][]string))
+	rendered := parseMappings(block)[host.hostname]
+	if !slices.Equal(rendered, entryIPs(host.ip_addresses)) {
+		fmt.Printf("FAIL: rendered entries for %s don't match its addresses: %s\n", hostname, strings.Join(block, " | "))
+		return 1
+	}
+	fmt.Printf("ok: rendered %d lines for %s\n", len(block), hostname)
+
+	fmt.Println("PASS")
+	return 0
+}
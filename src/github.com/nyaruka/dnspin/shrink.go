@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// whether removing more entries than our limits allow has been confirmed, by --force or the confirm admin command
+var shrink_confirmed bool
+
+// checks that going from the passed in old lines to the new ones doesn't remove more entries than our
+// limits allow, as that's more likely a bad config or an outage than intended, unless it's been confirmed
+func checkShrink(path string, old_lines []string, new_lines []string) error {
+	if *max_removed <= 0 && *max_removed_ratio <= 0 {
+		return nil
+	}
+
+	old_mappings := parseMappings(old_lines)
+	new_mappings := parseMappings(new_lines)
+	removed := 0
+	for name := range old_mappings {
+		if _, kept := new_mappings[name]; !kept {
+			removed += 1
+		}
+	}
+
+	too_many := *max_removed > 0 && removed > *max_removed
+	if *max_removed_ratio > 0 && len(old_mappings) > 0 && float64(removed)/float64(len(old_mappings)) > *max_removed_ratio {
+		too_many = true
+	}
+	if !too_many {
+		return nil
+	}
+
+	if shrink_confirmed {
+		log.Printf("Removing %d of %d entries from %s as confirmed", removed, len(old_mappings), path)
+		return nil
+	}
+
+	// we can only be asked to confirm at runtime if we have an admin socket
+	if *admin_socket != "" {
+		log.Printf("WARNING: refusing to remove %d of %d entries from %s, send confirm to %s or restart with --force to allow it", removed, len(old_mappings), path, *admin_socket)
+	} else {
+		log.Printf("WARNING: refusing to remove %d of %d entries from %s, restart with --force to allow it", removed, len(old_mappings), path)
+	}
+	return errors.New(fmt.Sprintf("would remove %d of %d entries, exceeding our limits", removed, len(old_mappings)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// the state of a host as we report it for diagnostics
+type host_state struct {
+	Hostname    string            `json:"hostname"`
+	Server      string            `json:"server"`
+	IPAddresses []string          `json:"ip_addresses"`
+	Status      string            `json:"status"`
+	LastSuccess *time.Time        `json:"last_success,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// returns a short description of the state of this host
+func (h *host_config) status() string {
+	switch {
+	case !h.enabled:
+		return "disabled"
+	case h.ip_address == NIL:
+		return "pending"
+	case h.conflicted:
+		return "conflict"
+	case h.ip_address == ERROR:
+		return "error"
+	case h.ip_address == MISSING:
+		return "missing"
+	default:
+		return "ok"
+	}
+}
+
+func (h *host_config) state() host_state {
+	state := host_state{
+		Hostname:    h.hostname,
+		Server:      h.dns_server,
+		IPAddresses: h.ip_addresses,
+		Status:      h.status(),
+		Tags:        h.tags,
+	}
+	if !h.last_success.IsZero() {
+		last_success := h.last_success
+		state.LastSuccess = &last_success
+	}
+	return state
+}
+
+// writes the current state of our hosts as JSON to the passed in file, or stderr if that is empty
+func dumpState(path string, hosts []*host_config) error {
+	states := make([]host_state, len(hosts))
+	for i, host := range hosts {
+		states[i] = host.state()
+	}
+
+	out, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+
+	if path == "" {
+		_, err = os.Stderr.Write(out)
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
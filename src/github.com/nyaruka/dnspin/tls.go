@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// the TLS config used for DNS over TLS, QUIC or HTTPS, loaded at startup
+var tls_config *tls.Config
+
+// builds our TLS config from our client certificate and CA flags, without them we use the system roots
+// and present no client certificate
+func loadTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: *tls_server_name}
+
+	if *tls_cert != "" || *tls_key != "" {
+		if *tls_cert == "" || *tls_key == "" {
+			return nil, errors.New("--tls-cert and --tls-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(*tls_cert, *tls_key)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error loading client certificate: %v", err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if *tls_ca != "" {
+		pem, err := os.ReadFile(*tls_ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in %s", *tls_ca))
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
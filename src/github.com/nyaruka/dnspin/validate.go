@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// how long we give our validation command to run
+const VALIDATE_TIMEOUT = 30 * time.Second
+
+// runs our validation command with the passed in file as its last argument, returning an error with its
+// output if it doesn't exit zero
+func validateFile(path string) error {
+	args := append(strings.Fields(*validate_command), path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), VALIDATE_TIMEOUT)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Validation of %s by %s failed: %v: %s", path, args[0], err, strings.TrimSpace(string(output))))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// how long the config must go without changing before we reload it, so we don't read partial writes
+const WATCH_DEBOUNCE = 500 * time.Millisecond
+
+// watches the passed in config file in the background, sending on the returned channel once it has
+// stopped changing. We watch its directory so we also see editors and tools which replace the file.
+func watchConfig(path string) (<-chan struct{}, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		debounce := time.NewTimer(WATCH_DEBOUNCE)
+		debounce.Stop()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && !event.Has(fsnotify.Chmod) {
+					debounce.Reset(WATCH_DEBOUNCE)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching %s: %v", path, err)
+			case <-debounce.C:
+				// a reload already pending will pick up this change too
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changed, nil
+}
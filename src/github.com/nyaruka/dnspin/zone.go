@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transfers the zone of the passed in host from the server, returning the addresses of each name in it
+// with an A record
+func transferZone(host *host_config, server string) (map[string][]string, error) {
+	network, address := serverTransport(server)
+
+	t := &dns.Transfer{DialTimeout: host.dnsTimeout(), ReadTimeout: host.dnsTimeout(), WriteTimeout: host.dnsTimeout()}
+	if network == "tcp-tls" {
+		t.TLS = tls_config
+	}
+	m := &dns.Msg{}
+	m.SetAxfr(dns.Fqdn(host.queryName()))
+
+	envelopes, err := t.In(m, serverAddress(address, network))
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make(map[string][]net.IP)
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		for _, rr := range envelope.RR {
+			if a, is_a := rr.(*dns.A); is_a && usableIP(a.A) {
+				name := strings.ToLower(strings.TrimSuffix(a.Hdr.Name, "."))
+				ips[name] = append(ips[name], a.A)
+			}
+		}
+	}
+
+	entries := make(map[string][]string, len(ips))
+	for name, name_ips := range ips {
+		sortIPs(name_ips)
+		for _, ip := range name_ips {
+			entries[name] = append(entries[name], ip.String())
+		}
+	}
+	return entries, nil
+}
+
+// transfers the zone of the passed in host from each of its servers until one allows it, updating it
+// with the result
+func resolveZone(host *host_config, now time.Time) {
+	var entries map[string][]string
+	var err error
+	for _, server := range host.servers() {
+		entries, err = transferZone(host, server)
+		if err == nil {
+			break
+		}
+		log.Printf("Error transferring %s from %s: %s", host.queryName(), server, err)
+	}
+	if err != nil {
+		host.setError()
+		return
+	}
+
+	host.zone_entries = entries
+	host.next_query = now
+	if len(entries) == 0 {
+		host.ip_address = MISSING
+		log.Printf("%s = %s (zone)%s", host.hostname, host.ip_address, host.tagSuffix())
+		return
+	}
+
+	host.ip_address = ZONE
+	host.last_success = now
+	log.Printf("%s = %d names (zone)%s", host.hostname, len(entries), host.tagSuffix())
+}
+
+// returns whether the passed in name is in the zone of the passed in host
+func inZone(host *host_config, name string) bool {
+	zone := strings.ToLower(host.queryName())
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// returns the entries we pin for a zone, falling back to the current mappings for the names in the zone if
+// we couldn't transfer it or haven't yet
+func zoneLines(host *host_config, current_mappings map[string][]string) []block_line {
+	entries := host.zone_entries
+	lines := make([]block_line, 0, len(entries)+1)
+
+	if host.ip_address == ERROR || host.ip_address == NIL {
+		entries = make(map[string][]string)
+		for name, ip_addresses := range current_mappings {
+			if inZone(host, name) {
+				entries[name] = ip_addresses
+			}
+		}
+
+		// if we just haven't transferred this zone yet we keep what we had without noting it
+		if host.ip_address == ERROR && len(entries) > 0 {
+			lines = append(lines, commentLine("%s: cached zone%s, error during transfer from %s", host.hostname, host.cachedSince(), host.dns_server))
+		} else if host.ip_address == ERROR {
+			lines = append(lines, commentLine("%s: error during transfer from %s", host.hostname, host.dns_server))
+		}
+	} else if host.ip_address == MISSING {
+		return lines
+	}
+
+	// sort by name so our block is stable across transfers
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, ip_address := range entries[name] {
+			lines = append(lines, entryLine(ip_address, name))
+		}
+	}
+	return lines
+}